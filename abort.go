@@ -0,0 +1,108 @@
+//
+// Why connections are aborted, for ABORT events and the log.
+
+package smtpd
+
+import (
+	"errors"
+	"io"
+	"net"
+)
+
+// AbortReason is the general reason that a Conn aborted its
+// connection.
+type AbortReason int
+
+// The reasons for aborts.
+const (
+	_                AbortReason = iota
+	AbortEOF                     // the client closed the connection
+	AbortTimeout                 // reading a command timed out
+	AbortLineTooLong             // a command line was too long
+	AbortMsgTooBig               // a message was over Limits.MsgSize
+	AbortMsgTimeout              // a message took over Limits.MsgInput
+	AbortReadError               // any other error reading from the client
+	AbortWriteError              // an error writing a reply
+	AbortTLS                     // TLS setup failed
+	AbortProxy                   // there was a bad or missing PROXY header
+	AbortBadCmds                 // too many bad commands, or an unrecoverable one
+	AbortLimit                   // the session went over a per-session limit
+	AbortShutdown                // server shutdown or context cancellation
+	AbortClosed                  // the caller closed it with a 421 Reply()
+)
+
+var abortNames = map[AbortReason]string{
+	AbortEOF:         "connection closed",
+	AbortTimeout:     "command timeout",
+	AbortLineTooLong: "command line too long",
+	AbortMsgTooBig:   "message too big",
+	AbortMsgTimeout:  "message timeout",
+	AbortReadError:   "read error",
+	AbortWriteError:  "write error",
+	AbortTLS:         "TLS failure",
+	AbortProxy:       "bad PROXY header",
+	AbortBadCmds:     "bad commands",
+	AbortLimit:       "session limit",
+	AbortShutdown:    "shutdown",
+	AbortClosed:      "closed after 421",
+}
+
+func (r AbortReason) String() string {
+	if s, ok := abortNames[r]; ok {
+		return s
+	}
+	return "unknown abort reason"
+}
+
+// AbortError is the EventInfo.Err of an ABORT event. Err is the
+// underlying error, if there was one; for AbortLimit, it says which
+// limit it was. Read is how many bytes of the command, message, or
+// BDAT chunk we were reading had been read, if we were reading one.
+type AbortError struct {
+	Reason AbortReason
+	Err    error
+	Read   int64
+}
+
+func (e *AbortError) Error() string {
+	if e.Err == nil {
+		return e.Reason.String()
+	}
+	return e.Reason.String() + ": " + e.Err.Error()
+}
+
+// Unwrap returns e.Err.
+func (e *AbortError) Unwrap() error {
+	return e.Err
+}
+
+// readReason returns the AbortReason for err from reading a command
+// or the like.
+func readReason(err error) AbortReason {
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		return AbortTimeout
+	}
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return AbortEOF
+	}
+	return AbortReadError
+}
+
+// lineAbort aborts the connection because reading a line of at most
+// max bytes failed with err, or ran out of room.
+func (c *Conn) lineAbort(err error, max int64) {
+	why := AbortLineTooLong
+	if c.lr.N != 0 {
+		why = readReason(err)
+	}
+	c.abort(why, err, max-c.lr.N)
+}
+
+// abort aborts the connection for reason. Only the first abort is
+// recorded.
+func (c *Conn) abort(reason AbortReason, err error, read int64) {
+	c.state = sAbort
+	if c.aborted == nil {
+		c.aborted = &AbortError{Reason: reason, Err: err, Read: read}
+	}
+}
@@ -0,0 +1,84 @@
+//
+// Tests for the reasons given for ABORT events.
+
+package smtpd
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAbortReasons(t *testing.T) {
+	lim := DefaultLimits
+	lim.MsgSize = 10
+	lim.MsgDiscard = 0
+	lim.Noops = 3
+	cfg := Config{Limits: &lim}
+	cases := []struct {
+		client string
+		reason AbortReason
+		read   int64
+	}{
+		{"HELO localhost", AbortEOF, 0},
+		{"HELO " + strings.Repeat("a", 3000) + "\n", AbortLineTooLong, 2048},
+		{"HELO localhost\nMAIL FROM:<a@b.com>\nRCPT TO:<c@d.com>\nDATA\n12345678901234567890\n.\n", AbortMsgTooBig, 22},
+		{"FRED\nFRED\nFRED\nFRED\nFRED\nFRED\nFRED\n", AbortBadCmds, 0},
+		{"NOOP\nNOOP\nNOOP\nNOOP\n", AbortLimit, 0},
+		{"\n", AbortBadCmds, 0},
+	}
+	for _, c := range cases {
+		evts, out := runSmtpEvents(cfg, c.client)
+		evt := evts[len(evts)-1]
+		var ae *AbortError
+		if evt.What != ABORT || !errors.As(evt.Err, &ae) {
+			t.Fatalf("%q: wrong final event %+v\n%s", c.client, evt, out)
+		}
+		if ae.Reason != c.reason || ae.Read != c.read {
+			t.Fatalf("%q: wrong abort %+v (%v)", c.client, ae, ae)
+		}
+		if c.reason == AbortLimit && (evt.Arg != "too many NOOPs" || ae.Err.Error() != evt.Arg) {
+			t.Fatalf("%q: limit not reported: %+v", c.client, evt)
+		}
+	}
+}
+
+func TestAbortTimeout(t *testing.T) {
+	sc, cc := net.Pipe()
+	defer cc.Close()
+	lim := DefaultLimits
+	lim.CmdInput = 10 * time.Millisecond
+	conn := NewConn(sc, Config{Limits: &lim}, nil)
+	go func() {
+		buf := make([]byte, 1024)
+		for {
+			if _, err := cc.Read(buf); err != nil {
+				return
+			}
+		}
+	}()
+	evt := conn.Next()
+	var ae *AbortError
+	if evt.What != ABORT || !errors.As(evt.Err, &ae) || ae.Reason != AbortTimeout {
+		t.Fatalf("wrong event for timeout: %+v", evt)
+	}
+	if ne, ok := ae.Err.(net.Error); !ok || !ne.Timeout() {
+		t.Fatalf("wrong underlying error: %v", ae.Err)
+	}
+}
+
+// A too big message that times out while we discard it is a message
+// timeout, not a too big one.
+func TestAbortDiscardTimeout(t *testing.T) {
+	lim := DefaultLimits
+	lim.MsgSize = 10
+	lim.MsgInput = 50 * time.Millisecond
+	evts, out := runPipe(Config{Limits: &lim}, "HELO localhost\r\nMAIL FROM:<a@b.com>\r\nRCPT TO:<c@d.com>\r\nDATA\r\n", "12345678901234567890\r\n")
+	evt := evts[len(evts)-1]
+	var ae *AbortError
+	if evt.What != ABORT || !errors.As(evt.Err, &ae) || ae.Reason != AbortMsgTimeout {
+		t.Fatalf("wrong final event %+v\n%s", evt, out)
+	}
+}
@@ -0,0 +1,318 @@
+//
+// Parsing of MAIL FROM and RCPT TO addresses, following the Path
+// grammar of section 4.1.2 of http://tools.ietf.org/html/rfc5321
+// as extended for UTF-8 by http://tools.ietf.org/html/rfc6531.
+
+package smtpd
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"unicode/utf8"
+)
+
+// Address is a parsed MAIL FROM or RCPT TO address, ie a RFC 5321
+// reverse-path or forward-path. The null path '<>' has no Local part
+// or Domain. Domain is also empty for the special RCPT TO address
+// '<Postmaster>'.
+type Address struct {
+	Route  []string // obsolete source route domains, without the '@'s
+	Local  string   // local part, with any quoting removed
+	Quoted bool     // the local part was a quoted string
+	Domain string   // domain, or an address literal including its []
+}
+
+// IsNull returns true if a is the null path '<>'.
+func (a *Address) IsNull() bool {
+	return a.Local == "" && a.Domain == ""
+}
+
+// IsLiteral returns true if a's domain is an address literal such as
+// '[192.0.2.1]' or '[IPv6:2001:db8::1]'.
+func (a *Address) IsLiteral() bool {
+	return strings.HasPrefix(a.Domain, "[")
+}
+
+// String returns the mailbox in canonical form, without the route
+// or angle brackets. The local part is quoted only if it has to be.
+func (a *Address) String() string {
+	local := a.Local
+	if !isDotString(local) && !a.IsNull() {
+		local = quoteLocal(local)
+	}
+	if a.Domain == "" {
+		return local
+	}
+	return local + "@" + a.Domain
+}
+
+// ParseAddress parses s as a RFC 5321 Path, either with its angle
+// brackets (as in 'MAIL FROM:<...>') or without them (as in
+// EventInfo.Arg), in which case "" is the null path. It understands
+// quoted local parts, address literals, and source routes. Non-ASCII
+// UTF-8 is accepted as RFC 6531 allows; whether it is acceptable in
+// a given transaction is up to the caller.
+func ParseAddress(s string) (*Address, error) {
+	if !utf8.ValidString(s) {
+		return nil, errors.New("address is not valid UTF-8")
+	}
+	if strings.HasPrefix(s, "<") {
+		a, n, err := parsePath(s)
+		if err == nil && n != len(s) {
+			err = errors.New("trailing characters after address")
+		}
+		return a, err
+	}
+	if s == "" {
+		return &Address{}, nil
+	}
+	p := &addrParser{s: s}
+	a, err := p.mailbox()
+	if err == nil && p.p != len(p.s) {
+		err = p.errorf("unexpected character")
+	}
+	if err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// parsePath parses the Path at the start of s, which must start with
+// its '<', and returns the result and how much of s it used.
+func parsePath(s string) (*Address, int, error) {
+	p := &addrParser{s: s, p: 1}
+	if p.peek() == '>' {
+		return &Address{}, 2, nil
+	}
+	a, err := p.mailbox()
+	if err != nil {
+		return nil, 0, err
+	}
+	if p.peek() != '>' {
+		return nil, 0, p.errorf("missing '>'")
+	}
+	return a, p.p + 1, nil
+}
+
+// addrParser is a simple cursor over the address being parsed.
+type addrParser struct {
+	s string
+	p int
+}
+
+// peek returns the next byte, or 0 at the end.
+func (p *addrParser) peek() byte {
+	if p.p >= len(p.s) {
+		return 0
+	}
+	return p.s[p.p]
+}
+
+func (p *addrParser) errorf(format string, elems ...interface{}) error {
+	return fmt.Errorf("bad address at position %d: %s", p.p, fmt.Sprintf(format, elems...))
+}
+
+// mailbox parses '[A-d-l ":"] Mailbox'.
+func (p *addrParser) mailbox() (*Address, error) {
+	a := &Address{}
+	if p.peek() == '@' {
+		for {
+			p.p++
+			d, err := p.domain()
+			if err != nil {
+				return nil, err
+			}
+			a.Route = append(a.Route, d)
+			if p.peek() != ',' {
+				break
+			}
+			p.p++
+			if p.peek() != '@' {
+				return nil, p.errorf("expected '@' in source route")
+			}
+		}
+		if p.peek() != ':' {
+			return nil, p.errorf("expected ':' after source route")
+		}
+		p.p++
+	}
+
+	var err error
+	if p.peek() == '"' {
+		a.Quoted = true
+		a.Local, err = p.quotedString()
+	} else {
+		a.Local, err = p.dotString()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if p.peek() != '@' {
+		// RFC 5321 section 4.1.1.3: '<Postmaster>' is the only
+		// mailbox that may have no domain.
+		if a.Quoted || a.Route != nil || !strings.EqualFold(a.Local, "postmaster") {
+			return nil, p.errorf("missing '@'")
+		}
+		return a, nil
+	}
+	p.p++
+	if p.peek() == '[' {
+		a.Domain, err = p.addressLiteral()
+	} else {
+		a.Domain, err = p.domain()
+	}
+	if err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// isAtext is RFC 5322 atext, plus non-ASCII per RFC 6531.
+func isAtext(c byte) bool {
+	switch {
+	case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9', c >= 0x80:
+		return true
+	}
+	return strings.IndexByte("!#$%&'*+-/=?^_`{|}~", c) != -1
+}
+
+func isLetDig(c byte) bool {
+	return (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9') || c >= 0x80
+}
+
+// dotString parses 'Atom *("." Atom)'.
+func (p *addrParser) dotString() (string, error) {
+	start := p.p
+	for {
+		n := p.p
+		for p.p < len(p.s) && isAtext(p.s[p.p]) {
+			p.p++
+		}
+		if p.p == n {
+			return "", p.errorf("empty or invalid local part component")
+		}
+		if p.peek() != '.' {
+			return p.s[start:p.p], nil
+		}
+		p.p++
+	}
+}
+
+// quotedString parses a RFC 5321 Quoted-string and returns its
+// contents with the quoting removed.
+func (p *addrParser) quotedString() (string, error) {
+	var b strings.Builder
+	p.p++
+	for {
+		c := p.peek()
+		switch {
+		case c == '"':
+			p.p++
+			return b.String(), nil
+		case c == '\\':
+			p.p++
+			c = p.peek()
+			if c < 32 || c > 126 {
+				return "", p.errorf("bad quoted-pair")
+			}
+		case c == 0:
+			return "", p.errorf("unterminated quoted string")
+		case c < 32 || c == 127:
+			return "", p.errorf("bad character in quoted string")
+		}
+		b.WriteByte(c)
+		p.p++
+	}
+}
+
+// domain parses 'sub-domain *("." sub-domain)', where a sub-domain
+// starts and ends with a letter or digit and has only those and '-'.
+func (p *addrParser) domain() (string, error) {
+	start := p.p
+	for {
+		if !isLetDig(p.peek()) {
+			return "", p.errorf("bad domain")
+		}
+		for isLetDig(p.peek()) || p.peek() == '-' {
+			p.p++
+		}
+		if p.s[p.p-1] == '-' {
+			return "", p.errorf("domain component ends with '-'")
+		}
+		if p.peek() != '.' {
+			return p.s[start:p.p], nil
+		}
+		p.p++
+	}
+}
+
+// addressLiteral parses an address-literal, which is an IPv4 address,
+// 'IPv6:' and an IPv6 address, or a general 'tag:content' literal,
+// all inside [].
+func (p *addrParser) addressLiteral() (string, error) {
+	start := p.p
+	end := strings.IndexByte(p.s[start:], ']')
+	if end == -1 {
+		return "", p.errorf("unterminated address literal")
+	}
+	lit := p.s[start+1 : start+end]
+	for i := 0; i < len(lit); i++ {
+		// dcontent is %d33-90 / %d94-126
+		if lit[i] < 33 || lit[i] > 126 || lit[i] == '[' || lit[i] == '\\' {
+			return "", p.errorf("bad character in address literal")
+		}
+	}
+	idx := strings.IndexByte(lit, ':')
+	switch {
+	case idx == -1:
+		ip := net.ParseIP(lit)
+		if ip == nil || ip.To4() == nil {
+			return "", p.errorf("bad IPv4 address literal")
+		}
+	case strings.EqualFold(lit[:idx], "IPv6"):
+		ip := net.ParseIP(lit[idx+1:])
+		if ip == nil || !strings.Contains(lit[idx+1:], ":") {
+			return "", p.errorf("bad IPv6 address literal")
+		}
+	default:
+		// A general address literal has a Standardized-tag,
+		// which is a Ldh-str, and some content.
+		tag := lit[:idx]
+		if tag == "" || !isLetDig(tag[0]) || !isLetDig(tag[len(tag)-1]) || strings.Trim(tag, "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789-") != "" || idx == len(lit)-1 {
+			return "", p.errorf("bad address literal")
+		}
+	}
+	p.p = start + end + 1
+	return p.s[start:p.p], nil
+}
+
+// isDotString returns true if s can be used as a local part without
+// quoting.
+func isDotString(s string) bool {
+	if s == "" || s[0] == '.' || s[len(s)-1] == '.' || strings.Contains(s, "..") {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		if s[i] != '.' && !isAtext(s[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// quoteLocal quotes s as a Quoted-string.
+func quoteLocal(s string) string {
+	var b strings.Builder
+	b.WriteByte('"')
+	for i := 0; i < len(s); i++ {
+		if s[i] == '"' || s[i] == '\\' {
+			b.WriteByte('\\')
+		}
+		b.WriteByte(s[i])
+	}
+	b.WriteByte('"')
+	return b.String()
+}
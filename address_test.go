@@ -0,0 +1,102 @@
+//
+// Tests for RFC 5321 address parsing.
+
+package smtpd
+
+import (
+	"strings"
+	"testing"
+)
+
+var addrValidTests = []struct {
+	addr   string
+	local  string
+	domain string
+	route  string
+	str    string
+}{
+	{"<>", "", "", "", ""},
+	{"", "", "", "", ""},
+	{"<fred@example.com>", "fred", "example.com", "", "fred@example.com"},
+	{"fred.j.bloggs@example.com", "fred.j.bloggs", "example.com", "", "fred.j.bloggs@example.com"},
+	{"<f+x=y!z@ex-ample.com>", "f+x=y!z", "ex-ample.com", "", "f+x=y!z@ex-ample.com"},
+	{`<"fred bloggs"@example.com>`, "fred bloggs", "example.com", "", `"fred bloggs"@example.com`},
+	{`<"fred>\"\\"@example.com>`, `fred>"\`, "example.com", "", `"fred>\"\\"@example.com`},
+	{`<"fred"@example.com>`, "fred", "example.com", "", "fred@example.com"},
+	{"<fred@[192.0.2.1]>", "fred", "[192.0.2.1]", "", "fred@[192.0.2.1]"},
+	{"<fred@[IPv6:2001:db8::1]>", "fred", "[IPv6:2001:db8::1]", "", "fred@[IPv6:2001:db8::1]"},
+	{"<fred@[x-tag:stuff]>", "fred", "[x-tag:stuff]", "", "fred@[x-tag:stuff]"},
+	{"<@a.org,@b.org:fred@example.com>", "fred", "example.com", "a.org,b.org", "fred@example.com"},
+	{"@a.org:fred@example.com", "fred", "example.com", "a.org", "fred@example.com"},
+	{"<Postmaster>", "Postmaster", "", "", "Postmaster"},
+	{"<θ@δ.example>", "θ", "δ.example", "", "θ@δ.example"},
+}
+
+func TestGoodAddresses(t *testing.T) {
+	for _, inp := range addrValidTests {
+		a, err := ParseAddress(inp.addr)
+		if err != nil {
+			t.Fatalf("error on '%s': %v", inp.addr, err)
+		}
+		if a.Local != inp.local || a.Domain != inp.domain || strings.Join(a.Route, ",") != inp.route {
+			t.Fatalf("wrong parse of '%s': %+v", inp.addr, a)
+		}
+		if a.String() != inp.str {
+			t.Fatalf("wrong String() of '%s': got '%s' expected '%s'", inp.addr, a.String(), inp.str)
+		}
+	}
+}
+
+var addrInvalidTests = []string{
+	"<",
+	"<fred@example.com",
+	"<fred@example.com> ",
+	"<<>>",
+	"fred",
+	"<fred>",
+	`<"postmaster">`,
+	"@example.com",
+	"fred@",
+	"fred..bloggs@example.com",
+	".fred@example.com",
+	"fred.@example.com",
+	"fred@@example.com",
+	"fred@example..com",
+	"fred@example.com.",
+	"fred@-example.com",
+	"fred@example-.com",
+	"fred@exa_mple.com",
+	`"fred@example.com`,
+	`"fr` + "\x01" + `ed"@example.com`,
+	"fred bloggs@example.com",
+	"fred@[192.0.2.1",
+	"fred@[192.0.2.256]",
+	"fred@[IPv6:192.0.2.1]",
+	"fred@[x-tag:]",
+	"fred@[-tag:a]",
+	"@a.org;fred@example.com",
+	"@a.org,fred@example.com",
+	"@a.org:@b.org:fred@example.com",
+	"fred@example.com\"",
+	"\xffred@example.com",
+}
+
+func TestBadAddresses(t *testing.T) {
+	for _, inp := range addrInvalidTests {
+		if a, err := ParseAddress(inp); err == nil {
+			t.Fatalf("'%s' not detected as error: got %+v", inp, a)
+		}
+	}
+}
+
+// ParseCmd gives us the parsed address if it's valid.
+func TestCmdAddress(t *testing.T) {
+	s := ParseCmd(`RCPT TO:<"a b"@example.com> NOTIFY=NEVER`)
+	if s.Err != "" || s.Addr == nil || s.Addr.Local != "a b" || !s.Addr.Quoted || s.Params != "NOTIFY=NEVER" {
+		t.Fatalf("bad parse: %+v", s)
+	}
+	s = ParseCmd("MAIL FROM:<barney>")
+	if s.Err != "" || s.Addr != nil {
+		t.Fatalf("bad parse: %+v", s)
+	}
+}
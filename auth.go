@@ -0,0 +1,232 @@
+//
+// SMTP AUTH support, per http://tools.ietf.org/html/rfc4954.
+// We drive the SASL exchange for the PLAIN, LOGIN, and CRAM-MD5
+// mechanisms ourselves and call out to an Authenticator to actually
+// check credentials.
+
+package smtpd
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Authenticator checks SMTP AUTH credentials for a Conn.
+//
+// Authenticate is used for the PLAIN and LOGIN mechanisms. authzid is
+// the authorization identity from PLAIN, which is usually empty; it
+// is up to the Authenticator to decide if user may act as it. The
+// return is true if the credentials are good. A non-nil error makes
+// the AUTH attempt fail temporarily, regardless of the bool.
+type Authenticator interface {
+	Authenticate(c *Conn, authzid, user, pass string) (bool, error)
+}
+
+// CRAMAuthenticator is an Authenticator that can also support
+// CRAM-MD5. Since CRAM-MD5 requires the server to know the shared
+// secret, CRAMSecret returns the secret for user; ok is false if
+// there is no such user. A non-nil error makes the AUTH attempt fail
+// temporarily.
+type CRAMAuthenticator interface {
+	Authenticator
+	CRAMSecret(c *Conn, user string) (secret string, ok bool, err error)
+}
+
+// authMechs returns the SASL mechanisms we currently offer, which may
+// be none.
+func (c *Conn) authMechs() []string {
+	var mechs []string
+	if c.cfg.Authenticator == nil {
+		return nil
+	}
+	// Plaintext mechanisms are only offered over TLS unless we've
+	// been told otherwise.
+	if c.TLSOn || c.cfg.AuthInsecure {
+		mechs = append(mechs, "PLAIN", "LOGIN")
+	}
+	if _, ok := c.cfg.Authenticator.(CRAMAuthenticator); ok {
+		mechs = append(mechs, "CRAM-MD5")
+	}
+	return mechs
+}
+
+// redactAuth removes any initial response from an AUTH command line
+// so that we don't write credentials to the log.
+func redactAuth(line string) string {
+	if len(line) < 5 || !strings.EqualFold(line[:5], "AUTH ") {
+		return line
+	}
+	f := strings.Fields(line)
+	if len(f) < 3 {
+		return line
+	}
+	return fmt.Sprintf("%s %s <initial response>", f[0], f[1])
+}
+
+// readAuth sends a 334 challenge and reads and decodes the client's
+// response. It returns false if the exchange has failed, in which
+// case it has already replied to the client (or aborted).
+func (c *Conn) readAuth(challenge string) ([]byte, bool) {
+	c.reply("334 %s", base64.StdEncoding.EncodeToString([]byte(challenge)))
+	if c.state == sAbort {
+		return nil, false
+	}
+	c.lr.N = 2048
+	c.setReadDeadline(time.Now().Add(c.cfg.Limits.CmdInput))
+	line, err := c.rdr.ReadLine()
+	if err != nil || c.lr.N == 0 {
+		c.lineAbort(err, 2048)
+		c.logErr(err, true, "AUTH abort %s err: %v",
+			fmtBytesLeft(2048, c.lr.N), err)
+		return nil, false
+	}
+	c.log(LogRead, "<auth response>")
+	return c.decodeAuth(line)
+}
+
+// decodeAuth decodes a base64 client response, handling the '*'
+// cancellation.
+func (c *Conn) decodeAuth(s string) ([]byte, bool) {
+	if s == "*" {
+		c.reply("501 5.0.0 Authentication cancelled")
+		return nil, false
+	}
+	b, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		c.reply("501 5.5.2 Cannot decode response")
+		return nil, false
+	}
+	return b, true
+}
+
+func cramChallenge(name string) string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return fmt.Sprintf("<%s.%d@%s>", hex.EncodeToString(b),
+		time.Now().Unix(), name)
+}
+
+// authenticate handles an AUTH command from start to finish. arg
+// is the mechanism plus any initial response.
+func (c *Conn) authenticate(arg string) {
+	var user, authzid string
+	var ok bool
+	var err error
+
+	mechs := c.authMechs()
+	switch {
+	case c.cfg.Authenticator == nil:
+		c.reply("502 5.5.1 Not supported")
+		return
+	case c.state != sHelo:
+		// Before EHLO or in the middle of a transaction.
+		c.reply("503 5.5.1 Out of sequence command")
+		return
+	case c.AuthUser != "":
+		c.reply("503 5.5.1 Already authenticated")
+		return
+	}
+
+	f := strings.Fields(arg)
+	if len(f) > 2 {
+		c.reply("501 5.5.2 Bad AUTH command")
+		return
+	}
+	mech := strings.ToUpper(f[0])
+	offered := false
+	for _, m := range mechs {
+		offered = offered || m == mech
+	}
+	if !offered {
+		if (mech == "PLAIN" || mech == "LOGIN") && !c.TLSOn {
+			c.reply("538 5.7.11 Encryption required for requested authentication mechanism")
+		} else {
+			c.reply("504 5.5.4 Unrecognized authentication type")
+		}
+		return
+	}
+
+	// RFC 4954 initial response; '=' is an empty one.
+	var resp []byte
+	hasInitial := len(f) == 2
+	if hasInitial && f[1] != "=" {
+		if resp, ok = c.decodeAuth(f[1]); !ok {
+			return
+		}
+	}
+
+	switch mech {
+	case "PLAIN":
+		if !hasInitial {
+			if resp, ok = c.readAuth(""); !ok {
+				return
+			}
+		}
+		p := bytes.Split(resp, []byte{0})
+		if len(p) != 3 {
+			c.reply("501 5.5.2 Bad PLAIN response")
+			return
+		}
+		authzid, user = string(p[0]), string(p[1])
+		ok, err = c.cfg.Authenticator.Authenticate(c, authzid, user, string(p[2]))
+	case "LOGIN":
+		if !hasInitial {
+			if resp, ok = c.readAuth("Username:"); !ok {
+				return
+			}
+		}
+		user = string(resp)
+		if resp, ok = c.readAuth("Password:"); !ok {
+			return
+		}
+		ok, err = c.cfg.Authenticator.Authenticate(c, "", user, string(resp))
+	case "CRAM-MD5":
+		if hasInitial {
+			c.reply("501 5.5.2 CRAM-MD5 does not take an initial response")
+			return
+		}
+		challenge := cramChallenge(c.cfg.LocalName)
+		if resp, ok = c.readAuth(challenge); !ok {
+			return
+		}
+		idx := bytes.LastIndexByte(resp, ' ')
+		if idx == -1 {
+			c.reply("501 5.5.2 Bad CRAM-MD5 response")
+			return
+		}
+		user = string(resp[:idx])
+		var secret string
+		ca := c.cfg.Authenticator.(CRAMAuthenticator)
+		secret, ok, err = ca.CRAMSecret(c, user)
+		if ok && err == nil {
+			h := hmac.New(md5.New, []byte(secret))
+			h.Write([]byte(challenge))
+			want := []byte(hex.EncodeToString(h.Sum(nil)))
+			ok = subtle.ConstantTimeCompare(want, resp[idx+1:]) == 1
+		}
+	}
+
+	switch {
+	case err != nil:
+		c.logErr(err, false, "AUTH %s error for '%s': %v", mech, user, err)
+		c.reply("454 4.7.0 Temporary authentication failure")
+	case !ok:
+		// Failed authentication attempts count as bad commands,
+		// so that clients can't guess passwords forever.
+		c.badcmds++
+		c.log(LogError, "AUTH %s failed for '%s'", mech, user)
+		c.reply("535 5.7.8 Authentication credentials invalid")
+	default:
+		c.AuthUser = user
+		c.log(LogError, "AUTH %s succeeded for '%s'", mech, user)
+		c.reply("235 2.7.0 Authentication successful")
+	}
+}
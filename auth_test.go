@@ -0,0 +1,137 @@
+//
+// Tests for SMTP AUTH.
+
+package smtpd
+
+import (
+	"net"
+	"net/smtp"
+	"strings"
+	"testing"
+)
+
+// testAuth accepts user 'fred' with password 'secret'.
+type testAuth struct{}
+
+func (t testAuth) Authenticate(c *Conn, authzid, user, pass string) (bool, error) {
+	return user == "fred" && pass == "secret", nil
+}
+
+func (t testAuth) CRAMSecret(c *Conn, user string) (string, bool, error) {
+	return "secret", user == "fred", nil
+}
+
+func TestAuthExchange(t *testing.T) {
+	cfg := Config{Authenticator: testAuth{}, AuthInsecure: true}
+	server, actualout := runSmtpTestCfg(cfg, authServer, authClient)
+	if actualout != server {
+		t.Fatalf("Got:\n%s\nExpected:\n%s", actualout, server)
+	}
+}
+
+var authClient = `AUTH PLAIN AGZyZWQAc2VjcmV0
+EHLO localhost
+AUTH PLAIN AGZyZWQAd3Jvbmc=
+AUTH PLAIN
+*
+AUTH PLAIN !!!!
+AUTH FOO
+AUTH LOGIN
+ZnJlZA==
+c2VjcmV0
+AUTH PLAIN AGZyZWQAc2VjcmV0
+QUIT
+`
+var authServer = `220 localhost go-smtpd
+503 5.5.1 Out of sequence command
+250-localhost Hello 127.10.10.100:56789
+250-8BITMIME
+250-PIPELINING
+250-ENHANCEDSTATUSCODES
+250-SIZE 5242880
+250-AUTH PLAIN LOGIN CRAM-MD5
+250 HELP
+535 5.7.8 Authentication credentials invalid
+` + "334 \n" + `501 5.0.0 Authentication cancelled
+501 5.5.2 Cannot decode response
+504 5.5.4 Unrecognized authentication type
+334 VXNlcm5hbWU6
+334 UGFzc3dvcmQ6
+235 2.7.0 Authentication successful
+503 5.5.1 Already authenticated
+221 2.0.0 Goodbye
+`
+
+// Without TLS we should not offer plaintext mechanisms.
+func TestAuthNoTLS(t *testing.T) {
+	cfg := Config{Authenticator: testAuth{}}
+	server, actualout := runSmtpTestCfg(cfg, authNoTLSServer, authNoTLSClient)
+	if actualout != server {
+		t.Fatalf("Got:\n%s\nExpected:\n%s", actualout, server)
+	}
+}
+
+var authNoTLSClient = `EHLO localhost
+AUTH PLAIN AGZyZWQAc2VjcmV0
+QUIT
+`
+var authNoTLSServer = `220 localhost go-smtpd
+250-localhost Hello 127.10.10.100:56789
+250-8BITMIME
+250-PIPELINING
+250-ENHANCEDSTATUSCODES
+250-SIZE 5242880
+250-AUTH CRAM-MD5
+250 HELP
+538 5.7.11 Encryption required for requested authentication mechanism
+221 2.0.0 Goodbye
+`
+
+// The AUTH= parameter on MAIL FROM is only passed on if the client
+// has authenticated.
+func TestAuthParam(t *testing.T) {
+	client := "EHLO localhost\r\nMAIL FROM:<a@b.com> AUTH=fred+40b.com\r\nRSET\r\nAUTH PLAIN AGZyZWQAc2VjcmV0\r\nMAIL FROM:<a@b.com> AUTH=fred+40b.com\r\nQUIT\r\n"
+	var got []string
+	conn, _, _ := runConn(Config{Authenticator: testAuth{}, AuthInsecure: true}, strings.NewReader(client), nil, func(c *Conn, evt EventInfo) {
+		if evt.Cmd == MAILFROM {
+			got = append(got, evt.Params["AUTH"])
+		}
+	})
+	if len(got) != 2 || got[0] != "<>" || got[1] != "fred@b.com" {
+		t.Fatalf("wrong AUTH= parameters: %v", got)
+	}
+	if conn.AuthUser != "fred" {
+		t.Fatalf("wrong AuthUser: '%s'", conn.AuthUser)
+	}
+}
+
+// Drive PLAIN and CRAM-MD5 through the standard library SMTP client.
+func TestAuthClient(t *testing.T) {
+	for _, a := range []smtp.Auth{
+		smtp.PlainAuth("", "fred", "secret", "localhost"),
+		smtp.CRAMMD5Auth("fred", "secret"),
+	} {
+		sc, cc := net.Pipe()
+		conn := NewConn(sc, Config{Authenticator: testAuth{}, AuthInsecure: true}, nil)
+		go func() {
+			for {
+				evt := conn.Next()
+				if evt.What == DONE || evt.What == ABORT {
+					sc.Close()
+					return
+				}
+			}
+		}()
+		client, err := smtp.NewClient(cc, "localhost")
+		if err != nil {
+			t.Fatalf("client setup failed: %v", err)
+		}
+		if err = client.Auth(a); err != nil {
+			t.Fatalf("authentication failed: %v", err)
+		}
+		client.Quit()
+		if conn.AuthUser != "fred" {
+			t.Fatalf("wrong AuthUser: '%s'", conn.AuthUser)
+		}
+	}
+}
@@ -0,0 +1,233 @@
+//
+// Handling of bare CRs and LFs, ie ones that are not part of a CR LF
+// pair. RFC 5321 section 2.3.8 forbids them, but textproto (like
+// many MTAs) treats a bare LF as a line ending, including in the
+// '.' that ends DATA. When we front another MTA that disagrees about
+// where a message ends, a client can hide a second message inside
+// the first one ('SMTP smuggling', eg CVE-2023-51766).
+
+package smtpd
+
+import (
+	"bufio"
+	"io"
+	"strings"
+)
+
+// BarePolicy says what a Conn does about bare CRs and LFs in
+// commands and DATA messages. Under every policy but BareAllow, only
+// CR LF . CR LF ends a DATA message; a '.' line with any other line
+// endings is part of the message. Messages sent with BDAT are never
+// checked, since they can legitimately have anything in them.
+type BarePolicy int
+
+const (
+	// BareAllow treats a bare LF as a line ending everywhere,
+	// including in the end of DATA. This is the historical
+	// behavior.
+	BareAllow BarePolicy = iota
+	// BareReject rejects commands with a 501 and messages with a
+	// 554, which the Conn gives itself; such messages never reach
+	// the caller as GOTDATA events unless StreamData is set.
+	BareReject
+	// BareNormalize treats bare CRs and LFs in messages as line
+	// endings and bare LFs in commands as CR LF. Commands with a
+	// bare CR in them are rejected with a 501, as for BareReject.
+	BareNormalize
+	// BareFlag passes bare CRs through in messages and sets
+	// EventInfo.BareEOL and Conn.BareEOLSeen.
+	BareFlag
+)
+
+// readLine reads a command line, without its line ending.
+func (c *Conn) readLine() (string, error) {
+	c.BareEOLSeen = false
+	if c.cfg.BareEOL == BareAllow {
+		return c.rdr.ReadLine()
+	}
+	line, err := c.rdr.R.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	line = line[:len(line)-1]
+	if strings.HasSuffix(line, "\r") {
+		line = line[:len(line)-1]
+	} else {
+		c.BareEOLSeen = true
+	}
+	if strings.IndexByte(line, '\r') != -1 {
+		c.BareEOLSeen = true
+	}
+	return line, nil
+}
+
+// badBareCmd returns true if the command line we just read has bare
+// CRs or LFs that we reject. BareNormalize doesn't split a command
+// line at a bare CR, since a server that doesn't see it as a line
+// ending would read the two commands as one.
+func (c *Conn) badBareCmd(line string) bool {
+	switch c.cfg.BareEOL {
+	case BareReject:
+		return c.BareEOLSeen
+	case BareNormalize:
+		return strings.IndexByte(line, '\r') != -1
+	}
+	return false
+}
+
+// rejectBare rejects the message that we have just received if it
+// had bare CRs or LFs and we reject those. It returns true if it
+// did.
+func (c *Conn) rejectBare() bool {
+	if !c.BareEOLSeen || c.cfg.BareEOL != BareReject {
+		return false
+	}
+	c.log(LogError, "message has bare CR or LF")
+	// An LMTP message needs a reply for each recipient.
+	for !c.replied && c.state != sAbort {
+		c.reply("554 5.6.0 Message has bare CR or LF characters")
+		c.replyDone()
+	}
+	return true
+}
+
+// The states of a dotReader.
+const (
+	dotBeginLine = iota // at the start of a line
+	dotData             // in the middle of a line
+	dotCR               // just after a CR in a line
+	dotDot              // just after a '.' that started a line
+	dotDotCR            // just after a '.' and CR that started a line
+	dotEOF              // read the end of the message
+)
+
+// dotReader is our version of textproto's DotReader, which undoes
+// dot-stuffing and turns CR LF line endings into LF. Only a '.' line
+// that is preceded and followed by CR LF ends the message. Lines
+// that end in bare LF are still unstuffed. Bare CRs become line
+// endings if the policy is BareNormalize and are passed through
+// otherwise.
+type dotReader struct {
+	c     *Conn
+	r     *bufio.Reader
+	state int
+	crlf  bool // the current line started after a CR LF
+	out   []byte
+}
+
+func (c *Conn) newDotReader() io.Reader {
+	c.BareEOLSeen = false
+	if c.cfg.BareEOL == BareAllow {
+		return c.rdr.DotReader()
+	}
+	return &dotReader{c: c, r: c.rdr.R, state: dotBeginLine, crlf: true}
+}
+
+func (d *dotReader) Read(b []byte) (int, error) {
+	n := 0
+	for n < len(b) {
+		if len(d.out) > 0 {
+			k := copy(b[n:], d.out)
+			if k == len(d.out) {
+				d.out = d.out[:0]
+			} else {
+				d.out = d.out[k:]
+			}
+			n += k
+			continue
+		}
+		if d.state == dotEOF {
+			return n, io.EOF
+		}
+		ch, err := d.r.ReadByte()
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return n, err
+		}
+		d.step(ch)
+	}
+	return n, nil
+}
+
+// bare records a bare CR or LF.
+func (d *dotReader) bare() {
+	d.c.BareEOLSeen = true
+}
+
+// step handles the next byte of the message.
+func (d *dotReader) step(ch byte) {
+	switch d.state {
+	case dotBeginLine:
+		if ch == '.' {
+			d.state = dotDot
+			return
+		}
+		d.data(ch)
+	case dotData:
+		d.data(ch)
+	case dotCR:
+		if ch == '\n' {
+			d.out = append(d.out, '\n')
+			d.state, d.crlf = dotBeginLine, true
+			return
+		}
+		d.bareCR()
+		d.step(ch)
+	case dotDot:
+		switch ch {
+		case '\r':
+			d.state = dotDotCR
+		case '\n':
+			// A '.' line that ends with a bare LF.
+			d.bare()
+			d.out = append(d.out, '.', '\n')
+			d.state, d.crlf = dotBeginLine, false
+		default:
+			// Dot-stuffing.
+			d.data(ch)
+		}
+	case dotDotCR:
+		if ch == '\n' && d.crlf {
+			d.state = dotEOF
+			return
+		}
+		d.out = append(d.out, '.')
+		if ch == '\n' {
+			// A '.' line after a bare line ending.
+			d.out = append(d.out, '\n')
+			d.state, d.crlf = dotBeginLine, true
+			return
+		}
+		d.bareCR()
+		d.step(ch)
+	}
+}
+
+// data handles a byte in the middle of a line.
+func (d *dotReader) data(ch byte) {
+	switch ch {
+	case '\r':
+		d.state = dotCR
+	case '\n':
+		d.bare()
+		d.out = append(d.out, '\n')
+		d.state, d.crlf = dotBeginLine, false
+	default:
+		d.out = append(d.out, ch)
+		d.state = dotData
+	}
+}
+
+// bareCR handles a CR that turned out not to be followed by a LF.
+func (d *dotReader) bareCR() {
+	d.bare()
+	if d.c.cfg.BareEOL == BareNormalize {
+		d.out = append(d.out, '\n')
+		d.state, d.crlf = dotBeginLine, false
+		return
+	}
+	d.out = append(d.out, '\r')
+	d.state = dotData
+}
@@ -0,0 +1,131 @@
+//
+// Tests for bare CR and LF handling, including the SMTP smuggling
+// variants.
+
+package smtpd
+
+import (
+	"strings"
+	"testing"
+)
+
+// The end of data sequences that some MTA or other has accepted.
+var smuggleEnds = []string{
+	"\n.\n",
+	"\n.\r\n",
+	"\r\n.\n",
+	"\r.\r\n",
+	"\r\n.\r",
+	"\r.\r",
+	"\n.\r",
+}
+
+func smuggleClient(end string) string {
+	return "EHLO localhost\r\nMAIL FROM:<a@b.com>\r\nRCPT TO:<c@d.com>\r\nDATA\r\nHi." + end + "MAIL FROM:<evil@b.com>\r\nRCPT TO:<c@d.com>\r\nDATA\r\nSmuggled\r\n.\r\nQUIT\r\n"
+}
+
+// runBare runs client, which must have its own line endings, against
+// a Conn with cfg, accepting everything. It returns the events other
+// than the final one, how many MAIL FROMs there were, and the server
+// output.
+func runBare(cfg Config, client string) ([]EventInfo, int, string) {
+	n := 0
+	_, evts, out := runConn(cfg, strings.NewReader(client), nil, func(_ *Conn, evt EventInfo) {
+		if evt.What == COMMAND && evt.Cmd == MAILFROM {
+			n++
+		}
+	})
+	return evts[:len(evts)-1], n, out
+}
+
+func TestSmuggling(t *testing.T) {
+	for _, end := range smuggleEnds {
+		for _, p := range []BarePolicy{BareNormalize, BareFlag} {
+			evts, n, out := runBare(Config{BareEOL: p}, smuggleClient(end))
+			last := evts[len(evts)-1]
+			if n != 1 || last.What != GOTDATA || !strings.Contains(last.Arg, "MAIL FROM:<evil@b.com>\n") {
+				t.Fatalf("%q with policy %d: message smuggled\n%s", end, p, out)
+			}
+			if last.BareEOL != (p == BareFlag) {
+				t.Fatalf("%q with policy %d: wrong BareEOL flag", end, p)
+			}
+			if p == BareNormalize && !strings.HasPrefix(last.Arg, "Hi.\n.\nMAIL FROM:<evil@b.com>\n") {
+				t.Fatalf("%q: message not normalized: %q", end, last.Arg)
+			}
+		}
+
+		evts, n, out := runBare(Config{BareEOL: BareReject}, smuggleClient(end))
+		if n != 1 || evts[len(evts)-1].What == GOTDATA || !strings.Contains(out, "\r\n554 5.6.0 ") || !strings.HasSuffix(out, "\r\n221 2.0.0 Goodbye\r\n") {
+			t.Fatalf("%q: message not rejected\n%s", end, out)
+		}
+	}
+
+	// This is what the policies guard against.
+	_, n, _ := runBare(Config{}, smuggleClient("\n.\n"))
+	if n != 2 {
+		t.Fatalf("BareAllow did not end the message at LF . LF")
+	}
+}
+
+// Proper messages aren't affected, including dot-stuffing and bare
+// CRs and LFs in the middle of lines.
+func TestBareMessages(t *testing.T) {
+	msg := "..stuffed\r\nline\rwith CR\r\nline\nwith LF\r\n.\r\n"
+	cases := []struct {
+		p    BarePolicy
+		want string
+	}{
+		{BareAllow, ".stuffed\nline\rwith CR\nline\nwith LF\n"},
+		{BareFlag, ".stuffed\nline\rwith CR\nline\nwith LF\n"},
+		{BareNormalize, ".stuffed\nline\nwith CR\nline\nwith LF\n"},
+	}
+	for _, c := range cases {
+		evts, _, out := runBare(Config{BareEOL: c.p}, "HELO localhost\r\nMAIL FROM:<a@b.com>\r\nRCPT TO:<c@d.com>\r\nDATA\r\n"+msg+"QUIT\r\n")
+		last := evts[len(evts)-1]
+		if last.What != GOTDATA || last.Arg != c.want {
+			t.Fatalf("policy %d: got %q\n%s", c.p, last.Arg, out)
+		}
+	}
+
+	evts, _, _ := runBare(Config{BareEOL: BareFlag}, "HELO localhost\r\nMAIL FROM:<a@b.com>\r\nRCPT TO:<c@d.com>\r\nDATA\r\nClean\r\n.\r\nQUIT\r\n")
+	if last := evts[len(evts)-1]; last.What != GOTDATA || last.BareEOL {
+		t.Fatalf("clean message flagged: %+v", last)
+	}
+}
+
+// With StreamData, a message with bare line endings is rejected when
+// the caller replies to it.
+func TestBareStream(t *testing.T) {
+	evts, _, out := runBare(Config{BareEOL: BareReject, StreamData: true}, smuggleClient("\n.\n"))
+	var got bool
+	for _, e := range evts {
+		got = got || e.What == GOTDATA
+	}
+	if !got || !strings.Contains(out, "\r\n554 5.6.0 ") || strings.Contains(out, "I've put it in a can") {
+		t.Fatalf("streamed message not rejected\n%s", out)
+	}
+}
+
+func TestBareCommands(t *testing.T) {
+	client := "EHLO localhost\nMAIL FROM:<a@b.com>\r\nRCPT TO:<c@d.com>\rfred\r\nQUIT\r\n"
+
+	_, _, out := runBare(Config{BareEOL: BareReject}, client)
+	if strings.Count(out, "501 5.5.2 Bad: bare CR or LF in command\r\n") != 2 {
+		t.Fatalf("bare line endings not rejected\n%s", out)
+	}
+
+	evts, _, out := runBare(Config{BareEOL: BareFlag}, client)
+	if evts[0].Cmd != EHLO || !evts[0].BareEOL || evts[1].Cmd != MAILFROM || evts[1].BareEOL {
+		t.Fatalf("wrong BareEOL flags: %+v\n%s", evts, out)
+	}
+
+	evts, _, out = runBare(Config{BareEOL: BareNormalize}, client)
+	if evts[0].Cmd != EHLO || evts[0].Arg != "localhost" || evts[1].Cmd != MAILFROM {
+		t.Fatalf("bare LF not normalized: %+v\n%s", evts, out)
+	}
+	// A bare CR can't hide a second command in the first one.
+	evts, n, out := runBare(Config{BareEOL: BareNormalize}, "EHLO localhost\r\nMAIL FROM:<a@b.com>\rRCPT TO:<evil@x>\r\nQUIT\r\n")
+	if len(evts) != 1 || n != 0 || !strings.Contains(out, "\r\n501 5.5.2 Bad: bare CR or LF in command\r\n") {
+		t.Fatalf("bare CR in command not rejected: %+v\n%s", evts, out)
+	}
+}
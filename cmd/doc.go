@@ -30,6 +30,26 @@ This attempts to group options together logically.
 		certificates with sinksmtp; see the TLS section.
 		You must give both options together (or neither).
 
+	-smtps [HOST]:PORT[,[HOST]:PORT...]
+		Also listen on these addresses for implicit TLS
+		connections, where TLS starts immediately instead of
+		through STARTTLS (as for the submissions port, 465).
+		Requires -c/-k. Connections on these addresses always
+		use TLS, even for clients that have had TLS failures.
+
+	-proxy [HOST]:PORT[,[HOST]:PORT...]
+		Connections to these listening addresses (which must be
+		given exactly as they are as arguments or to -smtps)
+		start with a HAProxy PROXY protocol header, version 1 or
+		2, giving the real client and local addresses. These are
+		then used for everything, including logging and rules.
+		Connections without a valid header are dropped.
+
+	-proxytrust CIDR[,CIDR...]
+		Only accept PROXY headers from these networks on -proxy
+		addresses; connections from elsewhere are handled
+		normally. This is required if -proxy is used.
+
 	-conncfg FILE
 		This file can be used to specify the -helo and -c/-k
 		settings for new connections based on the local IP
@@ -51,7 +71,8 @@ This attempts to group options together logically.
 		then refused.  If there already is a file with the same
 		hash-based name, we deliberately don't save over top of
 		it (and don't generate any errors). You probably want
-		-l too. The saved data includes message metadata.
+		-l too. The saved data includes message metadata, and
+		the message itself starts with our Received: header.
 	-save-hash TYPE
 		Base the hash name on one of three things. See 'Save
 		file hash naming' later. Valid types are 'msg', 'full',
@@ -165,7 +186,8 @@ Go only supports SSLv3+ and sinksmtp attempts to validate any client
 certificate that clients present to us. Both can cause TLS setup to
 fail. When TLS setup fails twice we remember the client IP and don't
 offer TLS to it if it reconnects within a certain amount of time
-(currently 72 hours).
+(currently 72 hours). This doesn't apply to -smtps connections,
+which must always use TLS.
 
 Some TLS-capable clients always start out by trying the SSLv2 protocol
 (and then advertising TLS in it). SSLv2 uses a different handshake
@@ -198,6 +220,9 @@ no hash collisions in SHA1 and the sender doesn't send two copies over
 the same connection in the same second; this is impossible if you use
 -S).
 
+None of the hashes include the Received: header that sinksmtp adds
+to saved messages, since it is different for every message.
+
 CONNECTION PARAMETERS
 
 In simple setups, fixed command line arguments are good enough for
@@ -557,12 +582,15 @@ AATTRS is one or more of:
 	bad	bad is equivalent to 'noat,quoted,unqualified,garbage',
 		ie everything except 'route' and 'resolves' et al.
 
-sinksmtp is somewhat casual about determining whether or not an address
-really has these attributes; basically it looks for characters in the
-address or at certain positions in the address instead of formally
-parsing it. 'resolves', 'baddom', and 'unknown' are not defined for
-garbage addresses, route addresses, unqualified addresses, or (obviously)
-addresses without an '@' ('noat').
+Addresses that are valid by RFC 5321 are parsed properly to determine
+these attributes; an address literal, eg 'fred@[192.0.2.1]', counts as
+unqualified. Addresses that are not valid are always garbage (unless
+they are noat), and sinksmtp is somewhat casual about determining their
+other attributes; basically it looks for characters in the address or
+at certain positions in the address. 'resolves', 'baddom', and
+'unknown' are not defined for garbage addresses, route addresses,
+unqualified addresses, or (obviously) addresses without an '@'
+('noat').
 
 DATTRS is one or more of:
 	nodns		remote IP has no verified hostnames
@@ -208,12 +208,52 @@ func heloGetter(c *Context) (o Option) {
 	return
 }
 
-// Analyze an address for its malfunctions
-// TODO: do this better in a more structured way.
+// Analyze an address for its malfunctions. Valid RFC 5321 addresses
+// are analyzed from their parsed form; everything else is guessed at.
 func getAddrOpts(a string, c *Context) (o Option) {
 	if a == "" {
 		return
 	}
+	addr, err := smtpd.ParseAddress(a)
+	if err != nil {
+		return guessAddrOpts(a)
+	}
+	switch {
+	case addr.Domain == "":
+		// <Postmaster>
+		o |= oNoat
+	case addr.IsLiteral() || strings.IndexByte(addr.Domain, '.') == -1:
+		o |= oUnqualified
+	}
+	if addr.Route != nil {
+		o |= oRoute
+	}
+	if addr.Quoted {
+		o |= oQuoted
+	}
+	if o&(oNoat|oUnqualified|oRoute) == 0 {
+		o |= c.domainOpts(addr.Domain)
+	}
+	return
+}
+
+// domainOpts returns the DNS options for an address domain.
+func (c *Context) domainOpts(domain string) Option {
+	switch c.validDomain(domain) {
+	case dnsGood:
+		return oDomainValid
+	case dnsBad:
+		return oDomainInvalid
+	case dnsTempfail:
+		return oDomainTempfail
+	}
+	return 0
+}
+
+// guessAddrOpts guesses at the options of an address that is not a
+// valid RFC 5321 address, by looking for characters in it or at
+// certain positions in it. It never has domain options.
+func guessAddrOpts(a string) (o Option) {
 	idx := strings.IndexByte(a, '@')
 	if idx == -1 {
 		o |= oNoat
@@ -249,17 +289,9 @@ func getAddrOpts(a string, c *Context) (o Option) {
 	if idx3 != -1 && idx3 != lp {
 		o |= oQuoted
 	}
-
-	if o&(oNoat|oUnqualified|oGarbage|oRoute) == 0 {
-		valid := c.validDomain(a[idx+1:])
-		switch valid {
-		case dnsGood:
-			o |= oDomainValid
-		case dnsBad:
-			o |= oDomainInvalid
-		case dnsTempfail:
-			o |= oDomainTempfail
-		}
+	// Anything we can't parse is garbage in the end.
+	if o&oNoat == 0 {
+		o |= oGarbage
 	}
 	return
 }
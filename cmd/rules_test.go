@@ -106,8 +106,11 @@ var aOpts = []struct {
 	{"joe@@jim.bob", oGarbage},
 	{"joe@jim.bob\"", oGarbage},
 	{"joe@jim.bob>", oGarbage},
-	// Ideally this wouldn't happen, but oh well
-	{"\"joe..bob\"@jim.bob", oQuoted | oGarbage},
+	{"\"joe..bob\"@jim.bob", oQuoted | oDomainInvalid},
+	{"\"joe>\"@jim.bob", oQuoted | oDomainInvalid},
+	{"joe@[192.0.2.1]", oUnqualified},
+	{"Postmaster", oNoat},
+	{"joe bob@jim.bob", oGarbage},
 }
 
 func TestAddrOpts(t *testing.T) {
@@ -8,6 +8,7 @@ import (
 	"bytes"
 	"crypto/sha1"
 	"crypto/tls"
+	"errors"
 	"flag"
 	"fmt"
 	"github.com/siebenmann/smtpd"
@@ -241,34 +242,21 @@ func (i *ipMap) Lookup(ip string, ttl time.Duration) (bool, int) {
 }
 
 // This is used to log the SMTP commands et al for a given SMTP session.
-// It encapsulates the prefix. Perhaps we could do this some other way,
-// for example with a function closure, but PUNT for now.
-// TODO: I'm convinced this is the wrong interface. See
-//    http://utcc.utoronto.ca/~cks/space/blog/programming/GoLoggingWrongIdiom
+// It encapsulates the prefix. It gets smtpd's log events and our own
+// notes, which are logged the same way.
 type smtpLogger struct {
-	prefix []byte
+	prefix string
 	writer *bufio.Writer
 }
 
-func (log *smtpLogger) Write(b []byte) (n int, err error) {
-	// MY HEAD HURTS. WHY DOES THIS HAPPEN.
-	// ... long story involving implicit casts to interfaces.
-	// This safety code is disabled because I want a crash if I screw
-	// this up at a higher level. This may be a mistake.
-	//if log == nil {
-	//	return
-	//}
-
-	// we might as well create the buffer at the right size.
-	buf := make([]byte, 0, len(b)+len(log.prefix))
-
-	buf = append(buf, log.prefix...)
-	buf = append(buf, b...)
-	n, err = log.writer.Write(buf)
-	if err == nil {
-		err = log.writer.Flush()
-	}
-	return n, err
+func (log *smtpLogger) Log(c *smtpd.Conn, e *smtpd.LogEvent) {
+	log.logf(e.Dir, "%s", e.Line)
+}
+
+// logf logs one of our own notes.
+func (log *smtpLogger) logf(dir smtpd.LogDir, format string, elems ...interface{}) {
+	fmt.Fprintf(log.writer, "%s%c %s\n", log.prefix, dir, fmt.Sprintf(format, elems...))
+	log.writer.Flush()
 }
 
 // ----
@@ -290,6 +278,7 @@ type smtpTransaction struct {
 	rcptto   []string
 
 	data     string
+	received string    // our Received header for data
 	hash     string    // canonical hash of the data, currently SHA1
 	bodyhash string    // canonical hash of the message body (no headers)
 	when     time.Time // when the email message data was received.
@@ -375,10 +364,18 @@ func msgDetails(prefix string, trans *smtpTransaction) ([]byte, string) {
 	}
 	fmt.Fprintf(writer, "hash %s bytes %d\n", trans.hash, len(trans.data))
 	fmt.Fprintf(writer, "bodyhash %s\n", trans.bodyhash)
-	fmt.Fprintf(writer, "body\n%s", trans.data)
+	fmt.Fprintf(writer, "body\n")
+	writer.Flush()
+	bodystart := outbuf2.Len()
+	fmt.Fprintf(writer, "%s", trans.data)
 	writer.Flush()
 	metahash := genHash(outbuf2.Bytes())
-	fwrite.Write(outbuf2.Bytes())
+	// The saved message gets our Received header, but it's left
+	// out of the hash since it's different every time.
+	b := outbuf2.Bytes()
+	fwrite.Write(b[:bodystart])
+	fwrite.WriteString(trans.received)
+	fwrite.Write(b[bodystart:])
 	fwrite.Flush()
 	return outbuf.Bytes(), metahash
 }
@@ -494,12 +491,11 @@ func logDnsbls(c *Context) {
 	}
 
 	sort.Strings(c.dnsblhit)
-	lmsg := fmt.Sprintf("! dnsbl hit: %s\n",
-		strings.Join(c.dnsblhit, " "))
+	lmsg := fmt.Sprintf("dnsbl hit: %s", strings.Join(c.dnsblhit, " "))
 	if lmsg == c.trans.lastmsg {
 		return
 	}
-	c.trans.log.Write([]byte(lmsg))
+	c.trans.log.logf(smtpd.LogError, "%s", lmsg)
 	c.trans.lastmsg = lmsg
 
 	// Special bonus feature: log actual SBL entries.
@@ -507,9 +503,8 @@ func logDnsbls(c *Context) {
 		if c.dnsblhit[i] == "sbl.spamhaus.org." {
 			sbls := getSBLHits(c.trans)
 			if len(sbls) > 0 {
-				lmsg = fmt.Sprintf("! SBL records: %s\n",
+				c.trans.log.logf(smtpd.LogError, "SBL records: %s",
 					strings.Join(sbls, " "))
-				c.trans.log.Write([]byte(lmsg))
 			}
 		}
 	}
@@ -559,7 +554,7 @@ func decider(ph Phase, evt smtpd.EventInfo, c *Context, convo *smtpd.Conn, id st
 	// this may be a mistake given EHLO retrying as HELO, but
 	// I'll see.
 	if note := c.withprops["note"]; note != "" {
-		c.trans.log.Write([]byte(fmt.Sprintf("! rule note: %s\n", note)))
+		c.trans.log.logf(smtpd.LogError, "rule note: %s", note)
 	}
 	if res == aNoresult || res == aAccept {
 		return false
@@ -602,16 +597,27 @@ func decider(ph Phase, evt smtpd.EventInfo, c *Context, convo *smtpd.Conn, id st
 }
 
 // Process a single connection.
-func process(cid int, nc net.Conn, certs []tls.Certificate, logf io.Writer, smtplog io.Writer, baserules []*Rule) {
+func process(cid int, lc listenConn, certs []tls.Certificate, logf io.Writer, smtplog io.Writer, baserules []*Rule) {
 	var evt smtpd.EventInfo
 	var convo *smtpd.Conn
 	var logger *smtpLogger
-	var l2 io.Writer
 	var gotsomewhere, stall, sesscounts bool
 	var cfg smtpd.Config
 
+	nc := lc.nc
 	defer nc.Close()
 
+	// Any PROXY header comes first and changes who the client
+	// (and the local address) is for everything that follows.
+	if lc.proxy {
+		var err error
+		nc, err = smtpd.ReadProxyHeader(nc, proxytrust, time.Minute)
+		if err != nil {
+			warnf("%v from %v\n", err, nc.RemoteAddr())
+			return
+		}
+	}
+
 	trans := &smtpTransaction{}
 	trans.savedir = savedir
 	trans.raddr = nc.RemoteAddr()
@@ -651,10 +657,10 @@ func process(cid int, nc net.Conn, certs []tls.Certificate, logf io.Writer, smtp
 
 	if smtplog != nil && !stall {
 		logger = &smtpLogger{}
-		logger.prefix = []byte(prefix)
+		logger.prefix = prefix
 		logger.writer = bufio.NewWriterSize(smtplog, 8*1024)
 		trans.log = logger
-		l2 = logger
+		cfg.Logger = logger
 	}
 
 	sname := trans.laddr.String()
@@ -707,8 +713,9 @@ func process(cid int, nc net.Conn, certs []tls.Certificate, logf io.Writer, smtp
 	// SSLv2 failure will cause them to try again in another
 	// connection with TLS only.
 	// See https://code.google.com/p/go/issues/detail?id=3930
+	// Implicit TLS connections have no choice about TLS.
 	blocktls, blcount := notls.Lookup(trans.rip, tlsTimeout)
-	if len(certs) > 0 && !(blocktls && blcount >= 2) {
+	if len(certs) > 0 && (lc.smtps || !(blocktls && blcount >= 2)) {
 		var tlsc tls.Config
 		tlsc.Certificates = certs
 		tlsc.ClientAuth = tls.VerifyClientCertIfGiven
@@ -716,9 +723,10 @@ func process(cid int, nc net.Conn, certs []tls.Certificate, logf io.Writer, smtp
 		tlsc.ServerName = sname
 		cfg.TLSConfig = &tlsc
 	}
+	cfg.ImplicitTLS = lc.smtps
 
 	// With everything set up we can now create the connection.
-	convo = smtpd.NewConn(nc, cfg, l2)
+	convo = smtpd.NewConn(nc, cfg, nil)
 
 	// Yes, we do rDNS lookup before our initial greeting banner and
 	// thus can pause a bit here. Clients will cope, or at least we
@@ -784,6 +792,7 @@ func process(cid int, nc net.Conn, certs []tls.Certificate, logf io.Writer, smtp
 			// message rejection is deferred until after logging
 			// et al.
 			trans.data = evt.Arg
+			trans.received = strings.Replace(convo.Received(prefix), "\r\n", "\n", -1)
 			trans.when = time.Now()
 			trans.tlson = convo.TLSOn
 			trans.cipher = convo.TLSCipher
@@ -804,11 +813,22 @@ func process(cid int, nc net.Conn, certs []tls.Certificate, logf io.Writer, smtp
 				}
 				doAccept(convo, c, transid)
 			}
+		case smtpd.TOOBIG:
+			// The client sent us a whole message, which is
+			// far enough that it isn't yakking, just as
+			// for one cut off while sending it.
+			sesscounts = false
 		case smtpd.TLSERROR:
-			// any TLS error means we'll avoid offering TLS
-			// to this source IP for a while.
-			notls.Add(trans.rip, tlsTimeout)
+			tlsFailed(lc, trans.rip)
 			sesscounts = false
+		case smtpd.ABORT:
+			// A client that was cut off while sending us a
+			// message got far enough that it isn't yakking,
+			// unlike one that timed out on commands.
+			var ae *smtpd.AbortError
+			if errors.As(evt.Err, &ae) && (ae.Reason == smtpd.AbortMsgTooBig || ae.Reason == smtpd.AbortMsgTimeout) {
+				sesscounts = false
+			}
 		}
 		if evt.What == smtpd.DONE || evt.What == smtpd.ABORT {
 			break
@@ -827,21 +847,38 @@ func process(cid int, nc net.Conn, certs []tls.Certificate, logf io.Writer, smtp
 		// log.
 		hit, cnt = yakkers.Lookup(trans.rip, yakTimeout)
 		if hit && cnt >= yakCount && smtplog != nil {
-			s := fmt.Sprintf("! %s added as a yakker at hit %d\n", trans.rip, cnt)
-			logger.Write([]byte(s))
+			logger.logf(smtpd.LogError, "%s added as a yakker at hit %d", trans.rip, cnt)
 		}
 	case yakCount > 0 && gotsomewhere:
 		yakkers.Del(trans.rip)
 	}
 }
 
+// A new connection and what sort of listener it came from.
+type listenConn struct {
+	nc    net.Conn
+	smtps bool // implicit TLS
+	proxy bool // expect a PROXY protocol header
+}
+
+// tlsFailed notes that TLS setup failed for a connection from ip.
+// A STARTTLS failure means we'll avoid offering TLS to this source
+// IP for a while. Implicit TLS failures don't count; they're mostly
+// scanners and plaintext clients on the wrong port, and say nothing
+// about how STARTTLS will go.
+func tlsFailed(lc listenConn, ip string) {
+	if !lc.smtps {
+		notls.Add(ip, tlsTimeout)
+	}
+}
+
 // Listen for new connections on a net.Listener, send the result to
 // the master.
-func listener(conn net.Listener, listenc chan net.Conn) {
+func listener(conn net.Listener, listenc chan listenConn, smtps, proxy bool) {
 	for {
 		nc, err := conn.Accept()
 		if err == nil {
-			listenc <- nc
+			listenc <- listenConn{nc, smtps, proxy}
 		}
 	}
 }
@@ -856,6 +893,7 @@ var heloreject string
 
 // other settings.
 var rulefiles []string
+var proxytrust []*net.IPNet
 
 var goslow bool
 var srvname string
@@ -979,6 +1017,8 @@ func main() {
 	var smtplogfile, logfile, rfiles string
 	var certfile, keyfile string
 	var pprofserv string
+	var smtpsaddrs string
+	var proxyaddrs, proxycidrs string
 	var force, nostdrules bool
 	var certs []tls.Certificate
 
@@ -993,6 +1033,9 @@ func main() {
 	flag.StringVar(&hashtype, "save-hash", "all", "what to base the hash name of saved messages on")
 	flag.StringVar(&certfile, "c", "", "TLS PEM certificate file; requires -k too")
 	flag.StringVar(&keyfile, "k", "", "TLS PEM key file; requires -c too")
+	flag.StringVar(&proxyaddrs, "proxy", "", "comma separated list of listening addresses that expect PROXY protocol headers")
+	flag.StringVar(&proxycidrs, "proxytrust", "", "comma separated list of CIDRs to accept PROXY protocol headers from")
+	flag.StringVar(&smtpsaddrs, "smtps", "", "comma separated list of [host]:port addresses to listen on with implicit TLS; requires -c/-k")
 	flag.StringVar(&fromreject, "fromreject", "", "file of address patterns to reject in MAIL FROMs")
 	flag.StringVar(&toaccept, "toaccept", "", "file of address patterns to accept in RCPT TOs")
 	flag.StringVar(&heloreject, "heloreject", "", "file of hostname patterns to reject in EHLOs")
@@ -1007,7 +1050,7 @@ func main() {
 	flag.Usage = usage
 
 	flag.Parse()
-	if flag.NArg() == 0 {
+	if flag.NArg() == 0 && smtpsaddrs == "" {
 		fmt.Fprintf(os.Stderr, "%s: no arguments given about what to listen on\n", os.Args[0])
 		fmt.Fprintf(os.Stderr, "usage: %s [options] [host]:port [[host]:port ...]\n", os.Args[0])
 		return
@@ -1045,6 +1088,30 @@ func main() {
 	case keyfile != "":
 		die("keyfile specified without certfile\n")
 	}
+	if smtpsaddrs != "" && len(certs) == 0 {
+		die("-smtps requires -c and -k\n")
+	}
+
+	// Listening addresses are matched against -proxy addresses
+	// textually, so they must be given the same way.
+	proxied := make(map[string]bool)
+	if proxyaddrs != "" {
+		for _, a := range strings.Split(proxyaddrs, ",") {
+			proxied[a] = true
+		}
+	}
+	if proxycidrs != "" {
+		for _, c := range strings.Split(proxycidrs, ",") {
+			_, n, err := net.ParseCIDR(c)
+			if err != nil {
+				die("bad -proxytrust CIDR '%s': %v\n", c, err)
+			}
+			proxytrust = append(proxytrust, n)
+		}
+	}
+	if proxyaddrs != "" && len(proxytrust) == 0 {
+		die("-proxy requires -proxytrust\n")
+	}
 
 	slogf, err := openlogfile(smtplogfile)
 	if err != nil {
@@ -1127,13 +1194,28 @@ func main() {
 	// Set up a pool of listeners, one per address that we're supposed
 	// to be listening on. These are goroutines that multiplex back to
 	// us on listenc.
-	listenc := make(chan net.Conn)
-	for i := 0; i < flag.NArg(); i++ {
-		conn, err := net.Listen("tcp", flag.Arg(i))
+	listenc := make(chan listenConn)
+	var used int
+	listen := func(a string, smtps bool) {
+		conn, err := net.Listen("tcp", a)
 		if err != nil {
-			die("error listening to tcp!%s: %s\n", flag.Arg(i), err)
+			die("error listening to tcp!%s: %s\n", a, err)
+		}
+		if proxied[a] {
+			used++
+		}
+		go listener(conn, listenc, smtps, proxied[a])
+	}
+	for i := 0; i < flag.NArg(); i++ {
+		listen(flag.Arg(i), false)
+	}
+	if smtpsaddrs != "" {
+		for _, a := range strings.Split(smtpsaddrs, ",") {
+			listen(a, true)
 		}
-		go listener(conn, listenc)
+	}
+	if used != len(proxied) {
+		die("-proxy addresses must all be listening addresses\n")
 	}
 
 	// Loop around getting new connections from our listeners and
@@ -1143,8 +1225,8 @@ func main() {
 	// a semi-unique ID for each conversation.
 	cid := 1
 	for {
-		nc := <-listenc
-		go process(cid, nc, certs, logf, slogf, baserules)
+		lc := <-listenc
+		go process(cid, lc, certs, logf, slogf, baserules)
 		cid++
 	}
 }
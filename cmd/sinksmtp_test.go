@@ -38,6 +38,19 @@ func TestLoader(t *testing.T) {
 	}
 }
 
+// TLS failures on implicit TLS listeners don't turn off STARTTLS.
+func TestTLSFailed(t *testing.T) {
+	tlsFailed(listenConn{smtps: true}, "192.0.2.1")
+	if hit, _ := notls.Lookup("192.0.2.1", tlsTimeout); hit {
+		t.Fatalf("implicit TLS failure blocked STARTTLS")
+	}
+	tlsFailed(listenConn{}, "192.0.2.1")
+	if hit, _ := notls.Lookup("192.0.2.1", tlsTimeout); !hit {
+		t.Fatalf("STARTTLS failure not recorded")
+	}
+	notls.Del("192.0.2.1")
+}
+
 var basiclist = `# This is a comment
 INFO@FBI.GOV
 root@
@@ -0,0 +1,196 @@
+//
+// Logging of what happens on a Conn, either as plain text lines to
+// an io.Writer or as LogEvents to a Logger.
+
+package smtpd
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// LogDir says what sort of thing a LogEvent records. Its values are
+// the characters that start lines in the plain text log.
+type LogDir byte
+
+// The kinds of LogEvents.
+const (
+	LogRead  LogDir = 'r' // read from the client
+	LogWrite LogDir = 'w' // written to the client, ie our replies
+	LogError LogDir = '!' // errors and other notable things
+	LogInfo  LogDir = '#' // the start and end of the connection
+)
+
+// LogEvent is a single logged event of a Conn. Line is the text of
+// the event as it appears in the plain text log; AUTH credentials
+// are never included. The other fields are set where they apply:
+//
+//   - Cmd is the parsed command of a command line the client sent,
+//     or BadCmd if it didn't parse.
+//   - Code is the reply code of a reply line we sent.
+//   - Err is the underlying error of a LogError event, if there was
+//     one.
+//   - Abort is true if the event ends the connection abnormally.
+type LogEvent struct {
+	Time   time.Time
+	ConnID uint64
+	Dir    LogDir
+	Line   string
+	Cmd    Command
+	Code   int
+	Err    error
+	Abort  bool
+}
+
+// Level returns the severity of e: LevelError for aborts,
+// LevelWarn for other errors, LevelInfo for the start and end of the
+// connection, and LevelDebug for the SMTP conversation itself.
+func (e *LogEvent) Level() slog.Level {
+	switch {
+	case e.Abort:
+		return slog.LevelError
+	case e.Dir == LogError:
+		return slog.LevelWarn
+	case e.Dir == LogInfo:
+		return slog.LevelInfo
+	}
+	return slog.LevelDebug
+}
+
+// Logger receives the LogEvents of Conns. Log is called synchronously
+// from the Conn's goroutine, so it should not block for long.
+type Logger interface {
+	Log(c *Conn, e *LogEvent)
+}
+
+// LoggerFunc is an adapter to allow ordinary functions to be
+// Loggers.
+type LoggerFunc func(c *Conn, e *LogEvent)
+
+// Log calls f(c, e).
+func (f LoggerFunc) Log(c *Conn, e *LogEvent) {
+	f(c, e)
+}
+
+// SlogLogger returns a Logger that logs LogEvents to l, at the
+// severity from LogEvent.Level() and with their fields as
+// attributes. Commands are logged by name, eg 'MAIL FROM'.
+func SlogLogger(l *slog.Logger) Logger {
+	return slogLogger{l}
+}
+
+type slogLogger struct {
+	l *slog.Logger
+}
+
+func (s slogLogger) Log(c *Conn, e *LogEvent) {
+	ctx := context.Background()
+	h := s.l.Handler()
+	if !h.Enabled(ctx, e.Level()) {
+		return
+	}
+	r := slog.NewRecord(e.Time, e.Level(), e.Line, 0)
+	r.AddAttrs(slog.Uint64("conn", e.ConnID), slog.String("dir", string(e.Dir)))
+	if e.Cmd != noCmd {
+		r.AddAttrs(slog.String("cmd", cmdName(e.Cmd)))
+	}
+	if e.Code != 0 {
+		r.AddAttrs(slog.Int("code", e.Code))
+	}
+	if e.Err != nil {
+		r.AddAttrs(slog.String("err", e.Err.Error()))
+	}
+	if e.Abort {
+		r.AddAttrs(slog.Bool("abort", true))
+	}
+	h.Handle(ctx, r)
+}
+
+// cmdName returns the name of cmd as the client sends it.
+func cmdName(cmd Command) string {
+	for _, c := range smtpCommand {
+		if c.cmd == cmd {
+			return c.text
+		}
+	}
+	return "BAD"
+}
+
+// connIDs is the last Conn ID handed out.
+var connIDs uint64
+
+func nextConnID() uint64 {
+	return atomic.AddUint64(&connIDs, 1)
+}
+
+// Log logs the fmt.Printf style message that you supply as a
+// LogError event, in the Conn's log writer and to Config.Logger, so
+// that callers (for example Verifiers) can note things about the
+// connection in its log.
+func (c *Conn) Log(format string, elems ...interface{}) {
+	c.log(LogError, format, elems...)
+}
+
+// logEvent fills in the common fields of e and logs it.
+func (c *Conn) logEvent(e *LogEvent) {
+	e.Time = time.Now()
+	e.ConnID = c.ID
+	if c.logger != nil {
+		c.logger.Write([]byte(fmt.Sprintf("%c %s\n", e.Dir, e.Line)))
+	}
+	if c.cfg.Logger != nil {
+		c.cfg.Logger.Log(c, e)
+	}
+}
+
+func (c *Conn) logging() bool {
+	return c.logger != nil || c.cfg.Logger != nil
+}
+
+func (c *Conn) log(dir LogDir, format string, elems ...interface{}) {
+	if !c.logging() {
+		return
+	}
+	c.logEvent(&LogEvent{Dir: dir, Line: fmt.Sprintf(format, elems...)})
+}
+
+// logErr logs err, which aborts the connection if abort is set.
+func (c *Conn) logErr(err error, abort bool, format string, elems ...interface{}) {
+	if !c.logging() {
+		return
+	}
+	c.logEvent(&LogEvent{Dir: LogError, Line: fmt.Sprintf(format, elems...), Err: err, Abort: abort})
+}
+
+// logAbort logs the end of an aborted connection, with the reason
+// if we know it.
+func (c *Conn) logAbort(why error) {
+	if !c.logging() {
+		return
+	}
+	c.logEvent(&LogEvent{Dir: LogInfo, Line: fmt.Sprintf("abort at %v", time.Now().Format(TimeFmt)), Err: why, Abort: true})
+}
+
+// logCmd logs a command line from the client and how it parsed.
+func (c *Conn) logCmd(line string, cmd Command) {
+	if !c.logging() {
+		return
+	}
+	c.logEvent(&LogEvent{Dir: LogRead, Line: redactAuth(line), Cmd: cmd})
+}
+
+// logReply logs a reply line.
+func (c *Conn) logReply(s string) {
+	if !c.logging() {
+		return
+	}
+	var code int
+	if len(s) >= 3 {
+		code, _ = strconv.Atoi(s[:3])
+	}
+	c.logEvent(&LogEvent{Dir: LogWrite, Line: s, Code: code})
+}
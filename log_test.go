@@ -0,0 +1,82 @@
+//
+// Tests for logging.
+
+package smtpd
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"strings"
+	"testing"
+)
+
+func TestLogEvents(t *testing.T) {
+	client := "EHLO localhost\r\nMAIL FROM:<a@b.com>\r\nFRED\r\nQUIT\r\n"
+	var logbuf bytes.Buffer
+	var evts []LogEvent
+	cfg := Config{Logger: LoggerFunc(func(c *Conn, e *LogEvent) {
+		if e.ConnID != c.ID || e.Time.IsZero() {
+			t.Fatalf("bad common fields: %+v", e)
+		}
+		evts = append(evts, *e)
+	})}
+	runConn(cfg, strings.NewReader(client), &logbuf, nil)
+
+	// The text log has the same events.
+	lines := strings.Split(strings.TrimSuffix(logbuf.String(), "\n"), "\n")
+	if len(lines) != len(evts) {
+		t.Fatalf("text log doesn't match events:\n%s", logbuf.String())
+	}
+	for i := range evts {
+		if lines[i] != string(evts[i].Dir)+" "+evts[i].Line {
+			t.Fatalf("text log line '%s' doesn't match event %+v", lines[i], evts[i])
+		}
+	}
+
+	var cmds []Command
+	var codes []int
+	for _, e := range evts {
+		switch e.Dir {
+		case LogRead:
+			cmds = append(cmds, e.Cmd)
+		case LogWrite:
+			codes = append(codes, e.Code)
+		}
+	}
+	if len(cmds) != 4 || cmds[0] != EHLO || cmds[1] != MAILFROM || cmds[2] != BadCmd || cmds[3] != QUIT {
+		t.Fatalf("wrong commands: %v", cmds)
+	}
+	if len(codes) != 10 || codes[0] != 220 || codes[8] != 501 || codes[9] != 221 {
+		t.Fatalf("wrong reply codes: %v", codes)
+	}
+	if last := evts[len(evts)-1]; last.Dir != LogInfo || last.Abort || last.Level() != slog.LevelInfo {
+		t.Fatalf("wrong final event: %+v", last)
+	}
+}
+
+func TestSlogLogger(t *testing.T) {
+	var logbuf bytes.Buffer
+	l := slog.New(slog.NewJSONHandler(&logbuf, &slog.HandlerOptions{Level: slog.LevelDebug}))
+	client := "EHLO localhost\r\nMAIL FROM:<a@b.com>\r\n"
+	runConn(Config{Logger: SlogLogger(l)}, strings.NewReader(client), nil, nil)
+
+	var recs []map[string]interface{}
+	for _, line := range strings.Split(strings.TrimSpace(logbuf.String()), "\n") {
+		var r map[string]interface{}
+		if err := json.Unmarshal([]byte(line), &r); err != nil {
+			t.Fatalf("bad JSON '%s': %v", line, err)
+		}
+		recs = append(recs, r)
+	}
+	var sawMail bool
+	for _, r := range recs {
+		if r["cmd"] == "MAIL FROM" && r["msg"] == "MAIL FROM:<a@b.com>" && r["level"] == "DEBUG" {
+			sawMail = true
+		}
+	}
+	last := recs[len(recs)-1]
+	if !sawMail || last["level"] != "ERROR" || last["abort"] != true || last["dir"] != "#" {
+		t.Fatalf("wrong records:\n%s", logbuf.String())
+	}
+}
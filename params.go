@@ -0,0 +1,222 @@
+//
+// Parsing of ESMTP MAIL FROM and RCPT TO parameters.
+// See http://www.ietf.org/rfc/rfc1869.txt and section 4.1.2 of
+// http://tools.ietf.org/html/rfc5321 for the grammar.
+
+package smtpd
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Params are the parsed ESMTP parameters of a MAIL FROM or RCPT TO
+// command. Keys are upper-cased parameter keywords. Values have had
+// any xtext encoding removed (see RFC 3461 section 4); a keyword that
+// was given without a value maps to "".
+type Params map[string]string
+
+// Has returns true if the parameter was given at all, with or without
+// a value.
+func (p Params) Has(key string) bool {
+	_, ok := p[strings.ToUpper(key)]
+	return ok
+}
+
+func isAlnum(c byte) bool {
+	return (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') ||
+		(c >= '0' && c <= '9')
+}
+
+// esmtp-keyword = (ALPHA / DIGIT) *(ALPHA / DIGIT / "-")
+func validKeyword(k string) bool {
+	if k == "" || !isAlnum(k[0]) {
+		return false
+	}
+	for i := 1; i < len(k); i++ {
+		if !isAlnum(k[i]) && k[i] != '-' {
+			return false
+		}
+	}
+	return true
+}
+
+// esmtp-value = 1*(%d33-60 / %d62-126)
+// ie any printable ASCII character except '='.
+func validValue(v string) bool {
+	if v == "" {
+		return false
+	}
+	for i := 0; i < len(v); i++ {
+		if v[i] < 33 || v[i] > 126 || v[i] == '=' {
+			return false
+		}
+	}
+	return true
+}
+
+func unhex(c byte) (byte, bool) {
+	switch {
+	case c >= '0' && c <= '9':
+		return c - '0', true
+	case c >= 'A' && c <= 'F':
+		return c - 'A' + 10, true
+	case c >= 'a' && c <= 'f':
+		// The RFC requires upper case hex digits, but we are
+		// generous in what we accept.
+		return c - 'a' + 10, true
+	}
+	return 0, false
+}
+
+// DecodeXtext decodes an RFC 3461 xtext string, where '+' followed
+// by two hex digits encodes an arbitrary byte.
+func DecodeXtext(s string) (string, error) {
+	if strings.IndexByte(s, '+') == -1 {
+		return s, nil
+	}
+	b := make([]byte, 0, len(s))
+	for i := 0; i < len(s); i++ {
+		if s[i] != '+' {
+			b = append(b, s[i])
+			continue
+		}
+		if i+2 >= len(s) {
+			return "", fmt.Errorf("truncated xtext escape in '%s'", s)
+		}
+		h, ok1 := unhex(s[i+1])
+		l, ok2 := unhex(s[i+2])
+		if !ok1 || !ok2 {
+			return "", fmt.Errorf("bad xtext escape in '%s'", s)
+		}
+		b = append(b, h<<4|l)
+		i += 2
+	}
+	return string(b), nil
+}
+
+// ParseParams parses the ESMTP parameters of a MAIL FROM or RCPT TO
+// command, as found in ParsedLine.Params. Keywords are matched case
+// independently; giving the same keyword twice is an error, as is
+// any parameter that does not match the RFC 1869 grammar.
+//
+// ParseParams returns a nil Params if there are no parameters.
+func ParseParams(s string) (Params, error) {
+	fields := strings.Fields(s)
+	if len(fields) == 0 {
+		return nil, nil
+	}
+	p := make(Params, len(fields))
+	for _, f := range fields {
+		var key, val string
+		idx := strings.IndexByte(f, '=')
+		if idx == -1 {
+			key = f
+		} else {
+			key = f[:idx]
+			val = f[idx+1:]
+			if !validValue(val) {
+				return nil, fmt.Errorf("bad value for parameter '%s'", key)
+			}
+		}
+		if !validKeyword(key) {
+			return nil, fmt.Errorf("bad parameter keyword '%s'", key)
+		}
+		key = strings.ToUpper(key)
+		if _, ok := p[key]; ok {
+			return nil, fmt.Errorf("duplicate parameter '%s'", key)
+		}
+		v, err := DecodeXtext(val)
+		if err != nil {
+			return nil, err
+		}
+		p[key] = v
+	}
+	return p, nil
+}
+
+// DSN holds the RFC 3461 Delivery Status Notification parameters of
+// a MAIL FROM (Ret and EnvID) or of a RCPT TO (Notify and ORcpt).
+// Keywords are upper-cased; EnvID and ORcpt have had their xtext
+// encoding removed.
+type DSN struct {
+	Ret    string   // FULL or HDRS
+	EnvID  string   // envelope ID
+	Notify []string // NEVER, or some of SUCCESS, FAILURE, and DELAY
+	// ORcptType is the address type of the original recipient,
+	// usually 'rfc822', and ORcpt is the address itself.
+	ORcptType string
+	ORcpt     string
+}
+
+// isDSNParam returns true if k is a DSN parameter for cmd.
+func isDSNParam(cmd Command, k string) bool {
+	switch cmd {
+	case MAILFROM:
+		return k == "RET" || k == "ENVID"
+	case RCPTTO:
+		return k == "NOTIFY" || k == "ORCPT"
+	}
+	return false
+}
+
+// isPrintable is true if s is all printable ASCII.
+func isPrintable(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] < 32 || s[i] > 126 {
+			return false
+		}
+	}
+	return true
+}
+
+// parseDSN parses and validates the DSN parameters in p. It returns
+// nil if there are none.
+func parseDSN(cmd Command, p Params) (*DSN, error) {
+	var d DSN
+	found := false
+	for k, v := range p {
+		if !isDSNParam(cmd, k) {
+			continue
+		}
+		found = true
+		switch k {
+		case "RET":
+			d.Ret = strings.ToUpper(v)
+			if d.Ret != "FULL" && d.Ret != "HDRS" {
+				return nil, fmt.Errorf("bad RET value '%s'", v)
+			}
+		case "ENVID":
+			if v == "" || len(v) > 100 || !isPrintable(v) {
+				return nil, fmt.Errorf("bad ENVID value")
+			}
+			d.EnvID = v
+		case "NOTIFY":
+			seen := make(map[string]bool)
+			for _, n := range strings.Split(strings.ToUpper(v), ",") {
+				switch {
+				case n != "NEVER" && n != "SUCCESS" && n != "FAILURE" && n != "DELAY":
+					return nil, fmt.Errorf("bad NOTIFY value '%s'", n)
+				case seen[n]:
+					return nil, fmt.Errorf("repeated NOTIFY value '%s'", n)
+				}
+				seen[n] = true
+				d.Notify = append(d.Notify, n)
+			}
+			if seen["NEVER"] && len(d.Notify) > 1 {
+				return nil, fmt.Errorf("NOTIFY=NEVER combined with other values")
+			}
+		case "ORCPT":
+			idx := strings.IndexByte(v, ';')
+			if idx < 1 || idx == len(v)-1 || !validKeyword(v[:idx]) || !isPrintable(v[idx+1:]) {
+				return nil, fmt.Errorf("bad ORCPT value")
+			}
+			d.ORcptType = v[:idx]
+			d.ORcpt = v[idx+1:]
+		}
+	}
+	if !found {
+		return nil, nil
+	}
+	return &d, nil
+}
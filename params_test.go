@@ -0,0 +1,188 @@
+//
+// Tests for ESMTP parameter parsing.
+
+package smtpd
+
+import (
+	"strings"
+	"testing"
+)
+
+var paramValidTests = []struct {
+	params string
+	res    Params
+}{
+	{"", nil},
+	{"SIZE=1000", Params{"SIZE": "1000"}},
+	{"size=1000 body=8BITMIME", Params{"SIZE": "1000", "BODY": "8BITMIME"}},
+	{"SMTPUTF8", Params{"SMTPUTF8": ""}},
+	{"X-VENDOR-1=yes   RET=HDRS", Params{"X-VENDOR-1": "yes", "RET": "HDRS"}},
+	// xtext decoding
+	{"ENVID=abc+2Bdef+3D", Params{"ENVID": "abc+def="}},
+	{"AUTH=<>", Params{"AUTH": "<>"}},
+	{"ORCPT=rfc822;fred+40example.com", Params{"ORCPT": "rfc822;fred@example.com"}},
+}
+
+func TestGoodParams(t *testing.T) {
+	for _, inp := range paramValidTests {
+		p, err := ParseParams(inp.params)
+		if err != nil {
+			t.Fatalf("error on '%s': %v", inp.params, err)
+		}
+		if len(p) != len(inp.res) {
+			t.Fatalf("wrong params on '%s': got %v expected %v", inp.params, p, inp.res)
+		}
+		for k, v := range inp.res {
+			if pv, ok := p[k]; !ok || pv != v {
+				t.Fatalf("wrong params on '%s': got %v expected %v", inp.params, p, inp.res)
+			}
+		}
+	}
+}
+
+var paramInvalidTests = []string{
+	"SIZE=",          // empty value
+	"=100",           // empty keyword
+	"-SIZE=100",      // keyword must start with alnum
+	"SI_ZE=100",      // bad keyword character
+	"SIZE=10=0",      // '=' in value
+	"SIZE=1 size=2",  // duplicate, case independently
+	"ENVID=abc+2",    // truncated xtext
+	"ENVID=abc+ZZdd", // bad xtext
+}
+
+func TestBadParams(t *testing.T) {
+	for _, inp := range paramInvalidTests {
+		p, err := ParseParams(inp)
+		if err == nil {
+			t.Fatalf("'%s' not detected as error: got %v", inp, p)
+		}
+	}
+}
+
+func TestParamReplies(t *testing.T) {
+	server, actualout := runSmtpTest(paramServer, paramClient)
+	if actualout != server {
+		t.Fatalf("Got:\n%s\nExpected:\n%s", actualout, server)
+	}
+}
+
+var paramClient = `EHLO localhost
+MAIL FROM:<a@b.com> BODY=BINARYMIME
+MAIL FROM:<a@b.com> SIZE=100=
+MAIL FROM:<a@b.com> BODY=7BIT BODY=7BIT
+MAIL FROM:<a@b.com> BODY=8bitmime
+RCPT TO:<c@d.com> BODY=7BIT
+QUIT
+`
+var paramServer = `220 localhost go-smtpd
+250-localhost Hello 127.10.10.100:56789
+250-8BITMIME
+250-PIPELINING
+250-ENHANCEDSTATUSCODES
+250-SIZE 5242880
+250 HELP
+555 5.5.4 Unsupported BODY type
+501 5.5.4 Bad parameters: bad value for parameter 'SIZE'
+501 5.5.4 Bad parameters: duplicate parameter 'BODY'
+250 2.1.0 Okay, I'll believe you for now
+555 5.5.4 MAIL FROM/RCPT TO parameters not recognized or not implemented
+221 2.0.0 Goodbye
+`
+
+// With NoParams off, unknown parameters are passed to the caller.
+func TestParamEvents(t *testing.T) {
+	client := "EHLO localhost\r\nMAIL FROM:<a@b.com> X-FRED=a+2Bb\r\nRCPT TO:<c@d.com> NOTIFY=NEVER\r\nQUIT\r\n"
+	lim := DefaultLimits
+	lim.NoParams = false
+	var got []Params
+	runConn(Config{Limits: &lim}, strings.NewReader(client), nil, func(c *Conn, evt EventInfo) {
+		if evt.Cmd == MAILFROM || evt.Cmd == RCPTTO {
+			got = append(got, evt.Params)
+		}
+	})
+	if len(got) != 2 || got[0]["X-FRED"] != "a+b" || !got[1].Has("notify") {
+		t.Fatalf("wrong params delivered: %v", got)
+	}
+}
+
+var dsnValidTests = []struct {
+	cmd    Command
+	params string
+	res    DSN
+}{
+	{MAILFROM, "RET=hdrs ENVID=QQ314159", DSN{Ret: "HDRS", EnvID: "QQ314159"}},
+	{MAILFROM, "RET=FULL", DSN{Ret: "FULL"}},
+	{RCPTTO, "NOTIFY=NEVER", DSN{Notify: []string{"NEVER"}}},
+	{RCPTTO, "NOTIFY=success,DELAY ORCPT=rfc822;fred+2Bbar@example.com",
+		DSN{Notify: []string{"SUCCESS", "DELAY"}, ORcptType: "rfc822", ORcpt: "fred+bar@example.com"}},
+}
+
+func TestGoodDSN(t *testing.T) {
+	for _, inp := range dsnValidTests {
+		p, _ := ParseParams(inp.params)
+		d, err := parseDSN(inp.cmd, p)
+		if err != nil || d == nil {
+			t.Fatalf("error on '%s': %v", inp.params, err)
+		}
+		if d.Ret != inp.res.Ret || d.EnvID != inp.res.EnvID || d.ORcpt != inp.res.ORcpt || d.ORcptType != inp.res.ORcptType || strings.Join(d.Notify, ",") != strings.Join(inp.res.Notify, ",") {
+			t.Fatalf("wrong DSN on '%s': got %+v expected %+v", inp.params, d, inp.res)
+		}
+	}
+	// DSN parameters on the wrong command are ignored here.
+	p, _ := ParseParams("NOTIFY=NEVER")
+	if d, err := parseDSN(MAILFROM, p); d != nil || err != nil {
+		t.Fatalf("NOTIFY on MAIL FROM gave %+v %v", d, err)
+	}
+}
+
+var dsnInvalidTests = []struct {
+	cmd    Command
+	params string
+}{
+	{MAILFROM, "RET=ALL"},
+	{MAILFROM, "ENVID=" + strings.Repeat("x", 101)},
+	{MAILFROM, "ENVID=a+00b"},
+	{RCPTTO, "NOTIFY=NEVER,SUCCESS"},
+	{RCPTTO, "NOTIFY=DELAY,DELAY"},
+	{RCPTTO, "NOTIFY=SOMETIMES"},
+	{RCPTTO, "NOTIFY=SUCCESS,"},
+	{RCPTTO, "ORCPT=fred@example.com"},
+	{RCPTTO, "ORCPT=rfc822;"},
+	{RCPTTO, "ORCPT=;fred@example.com"},
+}
+
+func TestBadDSN(t *testing.T) {
+	for _, inp := range dsnInvalidTests {
+		p, err := ParseParams(inp.params)
+		if err != nil {
+			t.Fatalf("cannot parse '%s': %v", inp.params, err)
+		}
+		if d, err := parseDSN(inp.cmd, p); err == nil {
+			t.Fatalf("'%s' not detected as error: got %+v", inp.params, d)
+		}
+	}
+}
+
+func TestDSNEvents(t *testing.T) {
+	client := `EHLO localhost
+MAIL FROM:<a@b.com> RET=HDRS ENVID=xyz
+RCPT TO:<c@d.com> NOTIFY=NEVER,DELAY
+RCPT TO:<c@d.com> NOTIFY=FAILURE ORCPT=rfc822;c+40d.com
+RCPT TO:<e@d.com>
+QUIT
+`
+	evts, out := runSmtpEvents(Config{DSN: true}, client)
+	if !strings.Contains(out, "250-DSN\r\n") || !strings.Contains(out, "501 5.5.4 Bad DSN parameter: NOTIFY=NEVER combined with other values\r\n") {
+		t.Fatalf("wrong server output:\n%s", out)
+	}
+	var dsns []*DSN
+	for _, e := range evts {
+		if e.Cmd == MAILFROM || e.Cmd == RCPTTO {
+			dsns = append(dsns, e.DSN)
+		}
+	}
+	if len(dsns) != 3 || dsns[0] == nil || dsns[0].EnvID != "xyz" || dsns[1] == nil || dsns[1].ORcpt != "c@d.com" || dsns[2] != nil {
+		t.Fatalf("wrong DSN information: %+v", dsns)
+	}
+}
@@ -0,0 +1,266 @@
+//
+// Support for the HAProxy PROXY protocol, versions 1 and 2, per
+// http://www.haproxy.org/download/1.8/doc/proxy-protocol.txt.
+// A load balancer or other proxy in front of us sends a header with
+// the real client and destination addresses before anything else.
+
+package smtpd
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ProxyHeader is the information from a PROXY protocol header.
+// Source and Dest are nil if the proxy didn't give addresses (a v1
+// UNKNOWN or a v2 LOCAL header), in which case the connection's own
+// addresses are used.
+type ProxyHeader struct {
+	Version int      // 1 or 2
+	Source  net.Addr // the real client
+	Dest    net.Addr // the address the client connected to
+	// TLVs holds any v2 type-length-value fields, by type.
+	TLVs map[byte][]byte
+	// TLS is set if a v2 header had a PP2_TYPE_SSL TLV.
+	TLS *ProxyTLS
+}
+
+// ProxyTLS is the TLS information from a v2 PP2_TYPE_SSL TLV,
+// describing the TLS connection between the client and the proxy.
+type ProxyTLS struct {
+	Client  byte   // PP2_CLIENT_* flags
+	Verify  uint32 // zero if the client presented a verified certificate
+	Version string // eg "TLSv1.3"
+	CN      string // common name of the client certificate, if any
+	Cipher  string
+	SigAlg  string
+	KeyAlg  string
+}
+
+// PROXY v2 TLV types that we decode.
+const (
+	pp2TypeSSL       = 0x20
+	pp2SubtypeVer    = 0x21
+	pp2SubtypeCN     = 0x22
+	pp2SubtypeCipher = 0x23
+	pp2SubtypeSigAlg = 0x24
+	pp2SubtypeKeyAlg = 0x25
+)
+
+var proxyV2Sig = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// ProxyConn is a net.Conn that a PROXY protocol header has been read
+// from. Its RemoteAddr() and LocalAddr() are the addresses from the
+// header, if there were any.
+type ProxyConn struct {
+	net.Conn
+	Header *ProxyHeader
+}
+
+// RemoteAddr returns the real client address.
+func (p *ProxyConn) RemoteAddr() net.Addr {
+	if p.Header.Source != nil {
+		return p.Header.Source
+	}
+	return p.Conn.RemoteAddr()
+}
+
+// LocalAddr returns the address the client connected to.
+func (p *ProxyConn) LocalAddr() net.Addr {
+	if p.Header.Dest != nil {
+		return p.Header.Dest
+	}
+	return p.Conn.LocalAddr()
+}
+
+// proxyTrusted returns true if we accept PROXY headers from addr.
+// An empty trusted list trusts nobody.
+func proxyTrusted(addr net.Addr, trusted []*net.IPNet) bool {
+	ip := remoteIP(addr)
+	for _, n := range trusted {
+		if ip != nil && n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// ReadProxyHeader reads a PROXY protocol header (either version)
+// from nc, which must be sent within timeout, and returns a
+// ProxyConn for the rest of the connection. If nc's remote address
+// is not in trusted, no header is expected and nc is returned as is;
+// an empty trusted list trusts nobody. A missing or invalid header
+// from a trusted source is an error.
+//
+// ReadProxyHeader reads exactly the header and nothing more, so it
+// can be used before a TLS handshake.
+func ReadProxyHeader(nc net.Conn, trusted []*net.IPNet, timeout time.Duration) (net.Conn, error) {
+	if !proxyTrusted(nc.RemoteAddr(), trusted) {
+		return nc, nil
+	}
+	nc.SetReadDeadline(time.Now().Add(timeout))
+	defer nc.SetReadDeadline(time.Time{})
+
+	var hdr *ProxyHeader
+	first := make([]byte, 1)
+	_, err := io.ReadFull(nc, first)
+	switch {
+	case err != nil:
+	case first[0] == 'P':
+		hdr, err = readProxyV1(nc)
+	case first[0] == '\r':
+		hdr, err = readProxyV2(nc)
+	default:
+		err = errors.New("no PROXY header")
+	}
+	if err != nil {
+		return nc, fmt.Errorf("PROXY header: %v", err)
+	}
+	return &ProxyConn{Conn: nc, Header: hdr}, nil
+}
+
+// readProxyV1 reads the rest of a text header, after its 'P'.
+func readProxyV1(r io.Reader) (*ProxyHeader, error) {
+	// A v1 header is at most 107 bytes including the CR NL. We
+	// must read it a byte at a time to not read past it.
+	line := []byte{'P'}
+	b := make([]byte, 1)
+	for !bytes.HasSuffix(line, []byte("\r\n")) {
+		if len(line) >= 107 {
+			return nil, errors.New("v1 header too long")
+		}
+		if _, err := io.ReadFull(r, b); err != nil {
+			return nil, err
+		}
+		line = append(line, b[0])
+	}
+	f := strings.Split(string(line[:len(line)-2]), " ")
+	if f[0] != "PROXY" || len(f) < 2 {
+		return nil, errors.New("bad v1 header")
+	}
+	hdr := &ProxyHeader{Version: 1}
+	if f[1] == "UNKNOWN" {
+		return hdr, nil
+	}
+	if len(f) != 6 || (f[1] != "TCP4" && f[1] != "TCP6") {
+		return nil, errors.New("bad v1 header")
+	}
+	src, dst := net.ParseIP(f[2]), net.ParseIP(f[3])
+	sport, err1 := strconv.ParseUint(f[4], 10, 16)
+	dport, err2 := strconv.ParseUint(f[5], 10, 16)
+	if src == nil || dst == nil || err1 != nil || err2 != nil || (src.To4() != nil) != (f[1] == "TCP4") || (dst.To4() != nil) != (f[1] == "TCP4") {
+		return nil, errors.New("bad v1 addresses")
+	}
+	hdr.Source = &net.TCPAddr{IP: src, Port: int(sport)}
+	hdr.Dest = &net.TCPAddr{IP: dst, Port: int(dport)}
+	return hdr, nil
+}
+
+// readProxyV2 reads the rest of a binary header, after its first
+// byte.
+func readProxyV2(r io.Reader) (*ProxyHeader, error) {
+	fixed := make([]byte, 16)
+	fixed[0] = '\r'
+	if _, err := io.ReadFull(r, fixed[1:]); err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(fixed[:12], proxyV2Sig) {
+		return nil, errors.New("bad v2 signature")
+	}
+	if fixed[12]>>4 != 2 {
+		return nil, fmt.Errorf("unknown v2 version %d", fixed[12]>>4)
+	}
+	body := make([]byte, binary.BigEndian.Uint16(fixed[14:]))
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, err
+	}
+
+	hdr := &ProxyHeader{Version: 2}
+	cmd := fixed[12] & 0xf
+	if cmd > 1 {
+		return nil, fmt.Errorf("unknown v2 command %d", cmd)
+	}
+	// The high nibble is the address family and the low one the
+	// transport protocol.
+	var alen int
+	switch fixed[13] >> 4 {
+	case 0: // unspecified
+	case 1: // IPv4
+		alen = 12
+	case 2: // IPv6
+		alen = 36
+	case 3: // unix sockets
+		alen = 216
+	default:
+		return nil, fmt.Errorf("unknown v2 address family 0x%02x", fixed[13])
+	}
+	if alen > len(body) {
+		return nil, errors.New("v2 header too short")
+	}
+	// A LOCAL command is the proxy talking to us for itself, eg
+	// for health checks, and its addresses are ignored. So are
+	// unix socket addresses.
+	if cmd == 1 && fixed[13]&0xf != 1 && fixed[13] != 0 {
+		return nil, errors.New("v2 connection is not a stream")
+	}
+	if cmd == 1 && (alen == 12 || alen == 36) {
+		n := (alen - 4) / 2
+		hdr.Source = &net.TCPAddr{IP: net.IP(body[:n]), Port: int(binary.BigEndian.Uint16(body[2*n:]))}
+		hdr.Dest = &net.TCPAddr{IP: net.IP(body[n : 2*n]), Port: int(binary.BigEndian.Uint16(body[2*n+2:]))}
+	}
+	return hdr, parseProxyTLVs(hdr, body[alen:])
+}
+
+// parseProxyTLVs parses the TLVs in b into hdr.
+func parseProxyTLVs(hdr *ProxyHeader, b []byte) error {
+	tlvs, err := splitTLVs(b)
+	if err != nil {
+		return err
+	}
+	if len(tlvs) == 0 {
+		return nil
+	}
+	hdr.TLVs = tlvs
+	ssl, ok := tlvs[pp2TypeSSL]
+	if !ok {
+		return nil
+	}
+	if len(ssl) < 5 {
+		return errors.New("bad v2 SSL TLV")
+	}
+	t := &ProxyTLS{Client: ssl[0], Verify: binary.BigEndian.Uint32(ssl[1:5])}
+	sub, err := splitTLVs(ssl[5:])
+	if err != nil {
+		return err
+	}
+	t.Version = string(sub[pp2SubtypeVer])
+	t.CN = string(sub[pp2SubtypeCN])
+	t.Cipher = string(sub[pp2SubtypeCipher])
+	t.SigAlg = string(sub[pp2SubtypeSigAlg])
+	t.KeyAlg = string(sub[pp2SubtypeKeyAlg])
+	hdr.TLS = t
+	return nil
+}
+
+func splitTLVs(b []byte) (map[byte][]byte, error) {
+	tlvs := make(map[byte][]byte)
+	for len(b) > 0 {
+		if len(b) < 3 {
+			return nil, errors.New("truncated v2 TLV")
+		}
+		l := int(binary.BigEndian.Uint16(b[1:3]))
+		if len(b) < 3+l {
+			return nil, errors.New("truncated v2 TLV")
+		}
+		tlvs[b[0]] = b[3 : 3+l]
+		b = b[3+l:]
+	}
+	return tlvs, nil
+}
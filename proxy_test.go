@@ -0,0 +1,162 @@
+//
+// Tests for PROXY protocol headers.
+
+package smtpd
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// proxyV2 builds a v2 PROXY header with the given command, family,
+// and body.
+func proxyV2(cmd, fam byte, body []byte) string {
+	var b bytes.Buffer
+	b.Write(proxyV2Sig)
+	b.WriteByte(0x20 | cmd)
+	b.WriteByte(fam)
+	binary.Write(&b, binary.BigEndian, uint16(len(body)))
+	b.Write(body)
+	return b.String()
+}
+
+func stringFaker(s string) *faker {
+	return &faker{ReadWriter: bufio.NewReadWriter(bufio.NewReader(strings.NewReader(s)), bufio.NewWriter(io.Discard))}
+}
+
+func tlv(t byte, v []byte) []byte {
+	return append([]byte{t, byte(len(v) >> 8), byte(len(v))}, v...)
+}
+
+// fakerNet trusts faker's RemoteAddr.
+var fakerNet = []*net.IPNet{{IP: net.IPv4(127, 0, 0, 0), Mask: net.CIDRMask(8, 32)}}
+
+var v4body = []byte{192, 0, 2, 1, 198, 51, 100, 7, 0x30, 0x39, 0, 25}
+
+var proxyValidTests = []struct {
+	hdr      string
+	src, dst string
+}{
+	{"PROXY TCP4 192.0.2.1 198.51.100.7 12345 25\r\n", "192.0.2.1:12345", "198.51.100.7:25"},
+	{"PROXY TCP6 2001:db8::1 2001:db8::2 12345 25\r\n", "[2001:db8::1]:12345", "[2001:db8::2]:25"},
+	{"PROXY UNKNOWN\r\n", "", ""},
+	{"PROXY UNKNOWN ffff::1 ffff::2 1 2\r\n", "", ""},
+	{proxyV2(1, 0x11, v4body), "192.0.2.1:12345", "198.51.100.7:25"},
+	{proxyV2(1, 0x21, append(append(net.ParseIP("2001:db8::1"), net.ParseIP("2001:db8::2")...), 0x30, 0x39, 0, 25)), "[2001:db8::1]:12345", "[2001:db8::2]:25"},
+	// LOCAL ignores any addresses.
+	{proxyV2(0, 0x11, v4body), "", ""},
+	{proxyV2(0, 0x00, nil), "", ""},
+}
+
+func TestGoodProxy(t *testing.T) {
+	for _, inp := range proxyValidTests {
+		cxn := stringFaker(inp.hdr + "EHLO")
+		nc, err := ReadProxyHeader(cxn, fakerNet, time.Second)
+		if err != nil {
+			t.Fatalf("error on %q: %v", inp.hdr, err)
+		}
+		pc, ok := nc.(*ProxyConn)
+		if !ok {
+			t.Fatalf("no ProxyConn for %q", inp.hdr)
+		}
+		src, dst := "", ""
+		if pc.Header.Source != nil {
+			src, dst = pc.RemoteAddr().String(), pc.LocalAddr().String()
+		}
+		if src != inp.src || dst != inp.dst {
+			t.Fatalf("wrong addresses for %q: %s %s", inp.hdr, src, dst)
+		}
+		// The header must be consumed exactly.
+		rest := make([]byte, 10)
+		n, _ := nc.Read(rest)
+		if string(rest[:n]) != "EHLO" {
+			t.Fatalf("wrong remaining data for %q: %q", inp.hdr, rest[:n])
+		}
+	}
+}
+
+var proxyInvalidTests = []string{
+	"EHLO localhost\r\n",
+	"PROXY\r\n",
+	"PROXY TCP4 192.0.2.1 198.51.100.7 12345\r\n",
+	"PROXY TCP4 2001:db8::1 198.51.100.7 12345 25\r\n",
+	"PROXY TCP4 192.0.2.1 198.51.100.7 123456 25\r\n",
+	"PROXY TCP4 192.0.2.1 198.51.100.7 12345 25",
+	"PROXY UNKNOWN " + strings.Repeat("x", 100) + "\r\n",
+	"\r\n\r\n\x00\r\nQUIX\n\x21\x11\x00\x00",
+	proxyV2(2, 0x11, v4body),
+	proxyV2(1, 0x12, v4body),
+	proxyV2(1, 0x11, v4body[:8]),
+	proxyV2(1, 0x11, append(v4body, 0x20, 0, 9)),
+}
+
+func TestBadProxy(t *testing.T) {
+	for _, inp := range proxyInvalidTests {
+		cxn := stringFaker(inp)
+		if _, err := ReadProxyHeader(cxn, fakerNet, time.Second); err == nil {
+			t.Fatalf("%q not detected as error", inp)
+		}
+	}
+}
+
+func TestProxyTLS(t *testing.T) {
+	sub := append(tlv(0x21, []byte("TLSv1.3")), tlv(0x22, []byte("client.example.com"))...)
+	ssl := append([]byte{0x07, 0, 0, 0, 0}, sub...)
+	body := append(append(append([]byte{}, v4body...), tlv(0x20, ssl)...), tlv(0x02, []byte("mx.example.com"))...)
+	cxn := stringFaker(proxyV2(1, 0x11, body))
+	nc, err := ReadProxyHeader(cxn, fakerNet, time.Second)
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+	h := nc.(*ProxyConn).Header
+	if h.TLS == nil || h.TLS.Client != 7 || h.TLS.Verify != 0 || h.TLS.Version != "TLSv1.3" || h.TLS.CN != "client.example.com" {
+		t.Fatalf("wrong TLS information: %+v", h.TLS)
+	}
+	if string(h.TLVs[0x02]) != "mx.example.com" {
+		t.Fatalf("wrong TLVs: %v", h.TLVs)
+	}
+}
+
+// Untrusted sources are not expected to send a header.
+func TestProxyUntrusted(t *testing.T) {
+	_, n, _ := net.ParseCIDR("10.0.0.0/8")
+	cxn := stringFaker("EHLO localhost\r\n")
+	nc, err := ReadProxyHeader(cxn, []*net.IPNet{n}, time.Second)
+	if err != nil || nc != net.Conn(cxn) {
+		t.Fatalf("untrusted source was not left alone: %v %v", nc, err)
+	}
+
+	// An empty list trusts nobody.
+	cxn = stringFaker("PROXY TCP4 192.0.2.1 198.51.100.7 12345 25\r\n")
+	nc, err = ReadProxyHeader(cxn, nil, time.Second)
+	if err != nil || nc != net.Conn(cxn) {
+		t.Fatalf("empty trusted list trusted a source: %v %v", nc, err)
+	}
+}
+
+func TestProxyConn(t *testing.T) {
+	client := "PROXY TCP4 192.0.2.1 198.51.100.7 12345 25\r\nEHLO localhost\r\nQUIT\r\n"
+	cfg := Config{ProxyProtocol: true, ProxyTrusted: fakerNet}
+	conn, _, out := runConn(cfg, strings.NewReader(client), nil, nil)
+	if !strings.Contains(out, "250-localhost Hello 192.0.2.1:12345\r\n") {
+		t.Fatalf("wrong server output:\n%s", out)
+	}
+	if conn.Proxy == nil || conn.RemoteAddr().String() != "192.0.2.1:12345" || conn.LocalAddr().String() != "198.51.100.7:25" {
+		t.Fatalf("wrong Conn addresses: %v %v", conn.RemoteAddr(), conn.LocalAddr())
+	}
+
+	// Without a header we abort without a banner.
+	_, evts, out := runConn(cfg, strings.NewReader("EHLO localhost\r\n"), nil, nil)
+	if len(evts) != 1 || evts[0].What != ABORT {
+		t.Fatalf("missing header did not abort: %+v", evts)
+	}
+	if out != "" {
+		t.Fatalf("unexpected output:\n%s", out)
+	}
+}
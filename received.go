@@ -0,0 +1,145 @@
+//
+// Generation of Received: trace headers, per section 4.4 of
+// http://tools.ietf.org/html/rfc5321, with the protocol names of
+// http://tools.ietf.org/html/rfc3848 and the TLS clause of
+// http://tools.ietf.org/html/rfc8314.
+
+package smtpd
+
+import (
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+)
+
+// Received returns a Received: header for the current transaction
+// of c, folded and with CR NL line endings. It has:
+//
+//   - a 'from' clause with the HELO name, or 'unknown' if that isn't
+//     valid, and the client's IP address;
+//   - a 'by' clause with Config.LocalName and Config.SftName;
+//   - a 'with' clause with the RFC 3848 protocol, eg ESMTPSA for
+//     ESMTP with TLS and AUTH, and the TLS version if any;
+//   - an 'id' clause if id isn't empty;
+//   - a 'for' clause if exactly one RCPT TO has been accepted, since
+//     listing more would reveal all recipients to each of them;
+//   - a 'tls' clause with the TLS cipher suite if any;
+//
+// and the current time.
+func (c *Conn) Received(id string) string {
+	var b strings.Builder
+
+	ip := remoteIP(c.RemoteAddr())
+	lit := ""
+	switch {
+	case ip == nil:
+	case ip.To4() != nil:
+		lit = "[" + ip.String() + "]"
+	default:
+		lit = "[IPv6:" + ip.String() + "]"
+	}
+	// The client's address always goes in the TCP-info comment,
+	// so a bad HELO name can't be replaced by it.
+	helo := c.helo
+	if !isDomain(helo) {
+		helo = "unknown"
+	}
+	b.WriteString("Received: from " + helo)
+	if lit != "" {
+		fmt.Fprintf(&b, " (%s)", lit)
+	}
+
+	fmt.Fprintf(&b, "\r\n\tby %s (%s) with %s", c.cfg.LocalName, c.cfg.SftName, c.protocol())
+	if c.TLSOn {
+		fmt.Fprintf(&b, " (%s)", tls.VersionName(c.TLSVersion))
+	}
+	switch {
+	case id != "" && c.nrcpts == 1:
+		fmt.Fprintf(&b, "\r\n\tid %s for <%s>", id, c.rcpt)
+	case id != "":
+		fmt.Fprintf(&b, "\r\n\tid %s", id)
+	case c.nrcpts == 1:
+		fmt.Fprintf(&b, "\r\n\tfor <%s>", c.rcpt)
+	}
+	if c.TLSOn {
+		fmt.Fprintf(&b, "\r\n\ttls %s", tls.CipherSuiteName(c.TLSCipher))
+	}
+	fmt.Fprintf(&b, ";\r\n\t%s\r\n", time.Now().Format(time.RFC1123Z))
+	return b.String()
+}
+
+// protocol returns the RFC 3848 (or RFC 6531) name for how the
+// current message is being received.
+func (c *Conn) protocol() string {
+	var p string
+	switch {
+	case c.cfg.LMTP && c.smtputf8:
+		p = "UTF8LMTP"
+	case c.cfg.LMTP:
+		p = "LMTP"
+	case c.smtputf8:
+		p = "UTF8SMTP"
+	case c.esmtp:
+		p = "ESMTP"
+	default:
+		return "SMTP"
+	}
+	if c.TLSOn {
+		p += "S"
+	}
+	if c.AuthUser != "" {
+		p += "A"
+	}
+	return p
+}
+
+// remoteIP returns the IP address of addr, or nil if it doesn't
+// have one.
+func remoteIP(addr net.Addr) net.IP {
+	if a, ok := addr.(*net.TCPAddr); ok {
+		return a.IP
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return nil
+	}
+	return net.ParseIP(host)
+}
+
+// isDomain returns true if s is a valid domain or address literal.
+func isDomain(s string) bool {
+	if s == "" {
+		return false
+	}
+	p := &addrParser{s: s}
+	var err error
+	if s[0] == '[' {
+		_, err = p.addressLiteral()
+	} else {
+		_, err = p.domain()
+	}
+	return err == nil && p.p == len(s)
+}
+
+// addReceived prepends our Received header to the message of evt if
+// we're supposed to. crlf is set if the message has CR NL line
+// endings, as it does from BDAT.
+func (c *Conn) addReceived(evt *EventInfo, crlf bool) {
+	if !c.cfg.AddReceived {
+		return
+	}
+	hdr := c.Received(fmt.Sprintf("%d.%d", c.ID, c.nmsgs))
+	if !crlf {
+		hdr = strings.Replace(hdr, "\r\n", "\n", -1)
+	}
+	if sp, ok := evt.Data.(*Spool); ok {
+		sp.hdr = hdr
+	} else if evt.Data != nil {
+		evt.Data = io.MultiReader(strings.NewReader(hdr), evt.Data)
+	} else {
+		evt.Arg = hdr + evt.Arg
+	}
+}
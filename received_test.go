@@ -0,0 +1,66 @@
+//
+// Tests for Received headers.
+
+package smtpd
+
+import (
+	"io"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+var receivedTests = []struct {
+	cfg    Config
+	client string
+	re     string
+}{
+	{Config{}, "EHLO mail.example.org\nMAIL FROM:<a@b.com>\nRCPT TO:<c@d.com>\nDATA\nHi.\n.\nQUIT\n",
+		`^Received: from mail\.example\.org \(\[127\.10\.10\.100\]\)\n\tby localhost \(go-smtpd\) with ESMTP\n\tid \d+\.1 for <c@d\.com>;\n\t\w\w\w, \d\d \w\w\w \d{4} [\d:]{8} [-+]\d{4}\nHi\.\n$`},
+	// Bad HELO names and several recipients.
+	{Config{}, "HELO bad_name\nMAIL FROM:<a@b.com>\nRCPT TO:<c@d.com>\nRCPT TO:<e@d.com>\nDATA\nHi.\n.\nQUIT\n",
+		`^Received: from unknown \(\[127\.10\.10\.100\]\)\n\tby localhost \(go-smtpd\) with SMTP\n\tid \d+\.1;\n`},
+	{Config{LMTP: true}, "LHLO x.org\nMAIL FROM:<a@b.com>\nRCPT TO:<c@d.com>\nDATA\nHi.\n.\nQUIT\n",
+		`^Received: from x\.org \(\[127\.10\.10\.100\]\)\n\tby localhost \(go-smtpd\) with LMTP\n`},
+	{Config{Chunking: true}, "EHLO x.org\nMAIL FROM:<a@b.com>\nRCPT TO:<c@d.com>\nBDAT 5 LAST\nHi.\nQUIT\n",
+		`^Received: from x\.org \(\[127\.10\.10\.100\]\)\r\n\tby localhost \(go-smtpd\) with ESMTP\r\n\tid \d+\.1 for <c@d\.com>;\r\n.*\r\nHi\.\r\n$`},
+}
+
+func TestReceived(t *testing.T) {
+	for _, inp := range receivedTests {
+		inp.cfg.AddReceived = true
+		evts, out := runSmtpEvents(inp.cfg, inp.client)
+		var msg string
+		for _, e := range evts {
+			if e.What == GOTDATA {
+				msg = e.Arg
+			}
+		}
+		if !regexp.MustCompile(inp.re).MatchString(msg) {
+			t.Fatalf("wrong message for '%s':\n%q\nserver output:\n%s", inp.client, msg, out)
+		}
+	}
+}
+
+func TestReceivedStream(t *testing.T) {
+	client := "EHLO x.org\r\nMAIL FROM:<a@b.com>\r\nRCPT TO:<c@d.com>\r\nDATA\r\nHi.\r\n.\r\nQUIT\r\n"
+	var msg []byte
+	runConn(Config{AddReceived: true, StreamData: true}, strings.NewReader(client), nil, func(c *Conn, evt EventInfo) {
+		if evt.What == GOTDATA {
+			msg, _ = io.ReadAll(evt.Data)
+		}
+	})
+	if !strings.HasPrefix(string(msg), "Received: from x.org ") || !strings.HasSuffix(string(msg), "\nHi.\n") {
+		t.Fatalf("wrong message: %q", msg)
+	}
+}
+
+func TestReceivedTLS(t *testing.T) {
+	c := &Conn{cfg: Config{LocalName: "mx.example.com", SftName: "go-smtpd"}, TLSOn: true, TLSVersion: 0x0304, TLSCipher: 0x1301, AuthUser: "fred", esmtp: true, helo: "[192.0.2.1]"}
+	c.setupConn(&faker{})
+	r := c.Received("")
+	want := "Received: from [192.0.2.1] ([127.10.10.100])\r\n\tby mx.example.com (go-smtpd) with ESMTPSA (TLS 1.3)\r\n\ttls TLS_AES_128_GCM_SHA256;\r\n"
+	if !strings.HasPrefix(r, want) {
+		t.Fatalf("wrong header:\n%q\nexpected prefix:\n%q", r, want)
+	}
+}
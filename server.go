@@ -0,0 +1,279 @@
+//
+// A SMTP server that handles the boring parts of running smtpd on
+// real listeners, loosely modelled on net/http's Server.
+
+package smtpd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// A Handler responds to the events of a SMTP connection. ServeSMTP
+// is called with every event that Conn.Next() returns, including
+// the final DONE or ABORT event. It may call Accept(), Reject(),
+// Tempfail() and so on; if it doesn't, the command is accepted.
+type Handler interface {
+	ServeSMTP(c *Conn, evt EventInfo)
+}
+
+// HandlerFunc is an adapter to allow ordinary functions to be
+// Handlers.
+type HandlerFunc func(c *Conn, evt EventInfo)
+
+// ServeSMTP calls f(c, evt).
+func (f HandlerFunc) ServeSMTP(c *Conn, evt EventInfo) {
+	f(c, evt)
+}
+
+// ErrServerClosed is returned by Server.Serve() and
+// Server.ListenAndServe() after Server.Shutdown() has been called.
+var ErrServerClosed = errors.New("smtpd: Server closed")
+
+// Server accepts SMTP connections on listeners and runs a Conn for
+// each of them.
+//
+// Every connection starts with a copy of Config. If ConnConfig is
+// set, it is then called to adjust the copy for this particular
+// connection (for example to pick a LocalName or TLS certificates
+// based on the local address) and to return the log writer to use,
+// which may be nil. If it returns an error, the connection is closed
+// without any greeting.
+//
+// Events are handed to Handler. If NewHandler is set, it is instead
+// called once for every connection to get the Handler for that
+// connection, which lets handlers keep per-connection state.
+//
+// If MaxConns is positive, connections beyond that many are given a
+// 421 greeting and closed; ConnConfig is not called for them.
+type Server struct {
+	Network string // network to listen on, "tcp" if empty
+	Addr    string // address to listen on, ":smtp" if empty for TCP
+	Config  Config // base configuration for every connection
+
+	ConnConfig func(nc net.Conn, cfg *Config) (log io.Writer, err error)
+	Handler    Handler
+	NewHandler func(c *Conn) Handler
+	MaxConns   int
+
+	mu        sync.Mutex
+	listeners map[net.Listener]struct{}
+	conns     map[*Conn]struct{}
+	nconns    int // including ones still being set up
+	closing   bool
+	wg        sync.WaitGroup
+	ctx       context.Context // cancelled to kill all connections
+	cancel    context.CancelFunc
+}
+
+// ListenAndServe listens on s.Addr and then calls Serve() to handle
+// connections. s.Network may be any stream network, for example
+// "unix" for LMTP on a unix domain socket.
+func (s *Server) ListenAndServe() error {
+	network, addr := s.Network, s.Addr
+	if network == "" {
+		network = "tcp"
+	}
+	if addr == "" && network == "tcp" {
+		addr = ":smtp"
+	}
+	l, err := net.Listen(network, addr)
+	if err != nil {
+		return err
+	}
+	return s.Serve(l)
+}
+
+// Serve accepts connections on l, handling each in its own
+// goroutine, until l fails or the Server is shut down. It always
+// returns a non-nil error and closes l. Serve may be called on
+// several listeners at once. Temporary errors from l.Accept() are
+// retried after a delay, as net/http does.
+func (s *Server) Serve(l net.Listener) error {
+	defer l.Close()
+	s.mu.Lock()
+	if s.closing {
+		s.mu.Unlock()
+		return ErrServerClosed
+	}
+	if s.listeners == nil {
+		s.listeners = make(map[net.Listener]struct{})
+	}
+	s.listeners[l] = struct{}{}
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		delete(s.listeners, l)
+		s.mu.Unlock()
+	}()
+
+	var delay time.Duration
+	for {
+		nc, err := l.Accept()
+		if err != nil {
+			s.mu.Lock()
+			closing := s.closing
+			s.mu.Unlock()
+			if closing {
+				return ErrServerClosed
+			}
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				if delay == 0 {
+					delay = 5 * time.Millisecond
+				} else {
+					delay *= 2
+				}
+				if delay > time.Second {
+					delay = time.Second
+				}
+				time.Sleep(delay)
+				continue
+			}
+			return err
+		}
+		delay = 0
+		go s.serveConn(nc)
+	}
+}
+
+// The 421 replies for connections we refuse, given our LocalName.
+const (
+	refuseClosing = "4.3.2 %s Service shutting down"
+	refuseBusy    = "4.7.0 %s Too many connections, try again later"
+)
+
+// serveConn runs a single connection from start to finish.
+func (s *Server) serveConn(nc net.Conn) {
+	defer nc.Close()
+
+	// Connections we are going to refuse don't get ConnConfig
+	// called for them.
+	if why := s.admit(); why != "" {
+		s.refuse(NewConn(nc, s.Config, nil), why)
+		return
+	}
+	defer s.release()
+
+	cfg := s.Config
+	var log io.Writer
+	if s.ConnConfig != nil {
+		var err error
+		if log, err = s.ConnConfig(nc, &cfg); err != nil {
+			return
+		}
+	}
+	c := NewConn(nc, cfg, log)
+	ctx := s.track(c)
+	if ctx == nil {
+		s.refuse(c, refuseClosing)
+		return
+	}
+	defer s.untrack(c)
+
+	h := s.Handler
+	if s.NewHandler != nil {
+		h = s.NewHandler(c)
+	}
+	for {
+		evt := c.NextContext(ctx)
+		if h != nil {
+			h.ServeSMTP(c, evt)
+		}
+		if evt.What == DONE || evt.What == ABORT {
+			return
+		}
+	}
+}
+
+// admit counts a new connection, unless we can't take another one,
+// in which case it returns which refusal to give it.
+func (s *Server) admit() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch {
+	case s.closing:
+		return refuseClosing
+	case s.MaxConns > 0 && s.nconns >= s.MaxConns:
+		return refuseBusy
+	}
+	s.nconns++
+	s.wg.Add(1)
+	return ""
+}
+
+func (s *Server) release() {
+	s.mu.Lock()
+	s.nconns--
+	s.mu.Unlock()
+	s.wg.Done()
+}
+
+// refuse gives c the 421 reply why.
+func (s *Server) refuse(c *Conn, why string) {
+	msg := fmt.Sprintf(why, c.cfg.LocalName)
+	c.log(LogError, "refused: %s", msg)
+	c.reply("421 %s", msg)
+}
+
+// track adds c to our active connections and returns the context
+// to run it with, or nil if we have started shutting down.
+func (s *Server) track(c *Conn) context.Context {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closing {
+		return nil
+	}
+	if s.conns == nil {
+		s.conns = make(map[*Conn]struct{})
+		s.ctx, s.cancel = context.WithCancel(context.Background())
+	}
+	s.conns[c] = struct{}{}
+	return s.ctx
+}
+
+func (s *Server) untrack(c *Conn) {
+	s.mu.Lock()
+	delete(s.conns, c)
+	s.mu.Unlock()
+}
+
+// Shutdown gracefully shuts down the server. It closes all
+// listeners, sends a 421 reply to and closes every connection that
+// is idle (ie not in the middle of a mail transaction), and then
+// waits for the remaining connections to finish their current
+// transaction and close in turn. If ctx expires first, Shutdown
+// cancels all remaining connections, which sends them a 421 reply
+// too, and returns ctx.Err().
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	s.closing = true
+	for l := range s.listeners {
+		l.Close()
+	}
+	for c := range s.conns {
+		c.shutdown()
+	}
+	s.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		s.mu.Lock()
+		if s.cancel != nil {
+			s.cancel()
+		}
+		s.mu.Unlock()
+		return ctx.Err()
+	}
+}
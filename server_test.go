@@ -0,0 +1,292 @@
+//
+// Tests for Server.
+
+package smtpd
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"net/smtp"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// startServer starts s on a loopback listener and returns its address
+// and a channel that will get the result of Serve().
+func startServer(t *testing.T, s *Server) (string, chan error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("cannot listen: %v", err)
+	}
+	res := make(chan error, 1)
+	go func() {
+		res <- s.Serve(l)
+	}()
+	return l.Addr().String(), res
+}
+
+// readReply reads a single (possibly multi-line) reply and returns
+// its last line.
+func readReply(t *testing.T, rdr *bufio.Reader) string {
+	for {
+		line, err := rdr.ReadString('\n')
+		if err != nil {
+			t.Fatalf("error reading reply: %v", err)
+		}
+		if len(line) < 4 || line[3] != '-' {
+			return strings.TrimRight(line, "\r\n")
+		}
+	}
+}
+
+func TestServer(t *testing.T) {
+	var mu sync.Mutex
+	var msgs []string
+	var ends []Event
+	s := &Server{
+		NewHandler: func(c *Conn) Handler {
+			var rcpts []string
+			return HandlerFunc(func(c *Conn, evt EventInfo) {
+				mu.Lock()
+				defer mu.Unlock()
+				switch {
+				case evt.What == COMMAND && evt.Cmd == RCPTTO:
+					rcpts = append(rcpts, evt.Arg)
+				case evt.What == GOTDATA:
+					msgs = append(msgs, strings.Join(rcpts, ",")+": "+evt.Arg)
+				case evt.What == DONE || evt.What == ABORT:
+					ends = append(ends, evt.What)
+				}
+			})
+		},
+	}
+	addr, res := startServer(t, s)
+
+	err := smtp.SendMail(addr, nil, "a@b.com", []string{"c@d.com", "e@f.com"}, []byte("Subject: test\r\n\r\nHi.\r\n"))
+	if err != nil {
+		t.Fatalf("SendMail failed: %v", err)
+	}
+
+	// An idle connection gets a 421 on shutdown.
+	nc, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("cannot dial: %v", err)
+	}
+	defer nc.Close()
+	rdr := bufio.NewReader(nc)
+	readReply(t, rdr)
+	nc.Write([]byte("HELO localhost\r\n"))
+	readReply(t, rdr)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err = s.Shutdown(ctx); err != nil {
+		t.Fatalf("Shutdown failed: %v", err)
+	}
+	if r := readReply(t, rdr); !strings.HasPrefix(r, "421 4.3.2 ") {
+		t.Fatalf("wrong shutdown reply: '%s'", r)
+	}
+	if err = <-res; err != ErrServerClosed {
+		t.Fatalf("wrong Serve() result: %v", err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(msgs) != 1 || msgs[0] != "c@d.com,e@f.com: Subject: test\n\nHi.\n" {
+		t.Fatalf("wrong messages: %q", msgs)
+	}
+	if len(ends) != 2 || ends[0] == ends[1] {
+		t.Fatalf("wrong final events: %v", ends)
+	}
+}
+
+// Shutdown waits for a transaction in progress to finish.
+func TestServerShutdownWaits(t *testing.T) {
+	s := &Server{}
+	addr, res := startServer(t, s)
+
+	nc, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("cannot dial: %v", err)
+	}
+	defer nc.Close()
+	rdr := bufio.NewReader(nc)
+	readReply(t, rdr)
+	nc.Write([]byte("HELO localhost\r\nMAIL FROM:<a@b.com>\r\n"))
+	readReply(t, rdr)
+	readReply(t, rdr)
+
+	done := make(chan error, 1)
+	go func() {
+		done <- s.Shutdown(context.Background())
+	}()
+	select {
+	case err = <-done:
+		t.Fatalf("Shutdown did not wait: %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+	nc.Write([]byte("RCPT TO:<c@d.com>\r\nDATA\r\nHi.\r\n.\r\n"))
+	for _, want := range []string{"250 2.1.5 ", "354 ", "250 2.0.0 ", "421 4.3.2 "} {
+		if r := readReply(t, rdr); !strings.HasPrefix(r, want) {
+			t.Fatalf("got reply '%s', expected '%s'", r, want)
+		}
+	}
+	if err = <-done; err != nil {
+		t.Fatalf("Shutdown failed: %v", err)
+	}
+	<-res
+}
+
+func TestServerMaxConns(t *testing.T) {
+	var mu sync.Mutex
+	setups := 0
+	s := &Server{MaxConns: 1}
+	s.ConnConfig = func(nc net.Conn, cfg *Config) (io.Writer, error) {
+		mu.Lock()
+		setups++
+		mu.Unlock()
+		return nil, nil
+	}
+	addr, _ := startServer(t, s)
+	defer s.Shutdown(context.Background())
+
+	nc1, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("cannot dial: %v", err)
+	}
+	defer nc1.Close()
+	if r := readReply(t, bufio.NewReader(nc1)); !strings.HasPrefix(r, "220 ") {
+		t.Fatalf("wrong first greeting: '%s'", r)
+	}
+	nc2, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("cannot dial: %v", err)
+	}
+	defer nc2.Close()
+	if r := readReply(t, bufio.NewReader(nc2)); !strings.HasPrefix(r, "421 4.7.0 ") {
+		t.Fatalf("wrong second greeting: '%s'", r)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if setups != 1 {
+		t.Fatalf("ConnConfig called %d times", setups)
+	}
+}
+
+type tempError struct{}
+
+func (tempError) Error() string   { return "temporary failure" }
+func (tempError) Timeout() bool   { return false }
+func (tempError) Temporary() bool { return true }
+
+// flakyListener fails its first errs Accepts with a temporary error.
+type flakyListener struct {
+	net.Listener
+	errs int
+}
+
+func (l *flakyListener) Accept() (net.Conn, error) {
+	if l.errs > 0 {
+		l.errs--
+		return nil, tempError{}
+	}
+	return l.Listener.Accept()
+}
+
+// Temporary Accept errors are retried, and Shutdown still closes
+// the listener afterwards.
+func TestServerTempError(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("cannot listen: %v", err)
+	}
+	s := &Server{}
+	res := make(chan error, 1)
+	go func() {
+		res <- s.Serve(&flakyListener{Listener: l, errs: 3})
+	}()
+
+	nc, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("cannot dial: %v", err)
+	}
+	if r := readReply(t, bufio.NewReader(nc)); !strings.HasPrefix(r, "220 ") {
+		t.Fatalf("wrong greeting: '%s'", r)
+	}
+	nc.Close()
+
+	s.Shutdown(context.Background())
+	select {
+	case err = <-res:
+		if err != ErrServerClosed {
+			t.Fatalf("wrong Serve result: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Serve did not return after Shutdown")
+	}
+}
+
+// If Shutdown's context expires, busy connections are cancelled.
+func TestServerShutdownTimeout(t *testing.T) {
+	s := &Server{}
+	addr, _ := startServer(t, s)
+
+	nc, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("cannot dial: %v", err)
+	}
+	defer nc.Close()
+	rdr := bufio.NewReader(nc)
+	readReply(t, rdr)
+	nc.Write([]byte("HELO localhost\r\nMAIL FROM:<a@b.com>\r\n"))
+	readReply(t, rdr)
+	readReply(t, rdr)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err = s.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("wrong Shutdown result: %v", err)
+	}
+	if r := readReply(t, rdr); !strings.HasPrefix(r, "421 4.3.2 ") {
+		t.Fatalf("wrong cancellation reply: '%s'", r)
+	}
+}
+
+// LMTP over a unix domain socket.
+func TestServerLMTPUnix(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "lmtp")
+	s := &Server{Network: "unix", Addr: path, Config: Config{LMTP: true}}
+	res := make(chan error, 1)
+	go func() {
+		res <- s.ListenAndServe()
+	}()
+	var nc net.Conn
+	var err error
+	for i := 0; i < 100; i++ {
+		if nc, err = net.Dial("unix", path); err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatalf("cannot dial: %v", err)
+	}
+	defer nc.Close()
+	rdr := bufio.NewReader(nc)
+	readReply(t, rdr)
+	nc.Write([]byte("LHLO localhost\r\nMAIL FROM:<a@b.com>\r\nRCPT TO:<c@d.com>\r\nRCPT TO:<e@d.com>\r\nDATA\r\nHi.\r\n.\r\n"))
+	for _, want := range []string{"250 HELP", "250 2.1.0 ", "250 2.1.5 ", "250 2.1.5 ", "354 ", "250 2.0.0 ", "250 2.0.0 "} {
+		if r := readReply(t, rdr); !strings.HasPrefix(r, want) {
+			t.Fatalf("got reply '%s', expected '%s'", r, want)
+		}
+	}
+	s.Shutdown(context.Background())
+	if err = <-res; err != ErrServerClosed {
+		t.Fatalf("wrong ListenAndServe() result: %v", err)
+	}
+}
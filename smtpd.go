@@ -13,11 +13,14 @@
 // series of meaningful SMTP events, primarily EHLO/HELO, MAIL
 // FROM, RCPT TO, DATA, and then the message data if things get
 // that far.
+// Alternately, a Server can run listeners and connections for you
+// and hand the events to a Handler.
 //
 // The Conn framework puts timeouts on input and output and size
 // limits on input messages (and input lines, but that's much larger
 // than the RFC requires so it shouldn't matter). See DefaultLimits
-// and SetLimits().
+// and SetLimits(). The message size limit is counted the way RFC 1870
+// does and is advertised through the SIZE extension.
 //
 package smtpd
 
@@ -25,13 +28,19 @@ package smtpd
 
 import (
 	"bufio"
+	"bytes"
+	"context"
 	"crypto/tls"
+	"errors"
 	"fmt"
 	"io"
 	"net"
 	"net/textproto"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
+	"unicode/utf8"
 )
 
 // The time format we log messages in.
@@ -41,7 +50,8 @@ const TimeFmt = "2006-01-02 15:04:05 -0700"
 type Command int
 
 // Recognized SMTP commands. Not all of them do anything
-// (eg AUTH, VRFY, and EXPN are just refused).
+// (eg VRFY and EXPN are just refused unless there is a Verifier in
+// the Config, as is AUTH unless there is an Authenticator).
 const (
 	noCmd  Command = iota // artificial zero value
 	BadCmd Command = iota
@@ -58,20 +68,29 @@ const (
 	HELP
 	AUTH
 	STARTTLS
+	BDAT
+	LHLO
+	XCLIENT
+	XFORWARD
 )
 
 // ParsedLine represents a parsed SMTP command line.  Err is set if
 // there was an error, empty otherwise. Cmd may be BadCmd or a
 // command, even if there was an error.
+//
+// For MAIL FROM and RCPT TO, Arg is the address without its angle
+// brackets. Addr is the parsed address if it is a valid RFC 5321
+// Path and nil otherwise; see ParseAddress.
 type ParsedLine struct {
 	Cmd    Command
 	Arg    string
 	Params string // present only on ESMTP MAIL FROM and RCPT TO.
+	Addr   *Address
 	Err    string
 }
 
 // See http://www.ietf.org/rfc/rfc1869.txt for the general discussion of
-// params. We do not parse them.
+// params. ParseCmd does not parse them; see ParseParams.
 
 type cmdArgs int
 
@@ -102,6 +121,10 @@ var smtpCommand = []struct {
 	{HELP, "HELP", canArg},
 	{STARTTLS, "STARTTLS", noArg},
 	{AUTH, "AUTH", mustArg},
+	{BDAT, "BDAT", mustArg},
+	{LHLO, "LHLO", canArg},
+	{XCLIENT, "XCLIENT", mustArg},
+	{XFORWARD, "XFORWARD", mustArg},
 	// TODO: do I need any additional SMTP commands?
 }
 
@@ -134,17 +157,46 @@ func isall7bit(b []byte) bool {
 	return true
 }
 
+// asciiUpper upper-cases only the ASCII letters in s, so that the
+// result always has the same length as s even if s is UTF-8.
+func asciiUpper(s string) string {
+	b := []byte(s)
+	for i, c := range b {
+		if c >= 'a' && c <= 'z' {
+			b[i] = c - ('a' - 'A')
+		}
+	}
+	return string(b)
+}
+
 // ParseCmd parses a SMTP command line and returns the result.
 // The line should have the ending CR-NL already removed.
 func ParseCmd(line string) ParsedLine {
+	return parseCmd(line, false)
+}
+
+// ParseCmdUTF8 is ParseCmd for connections that support SMTPUTF8
+// (RFC 6531). The line must be valid UTF-8, and non-ASCII characters
+// are accepted in the address of MAIL FROM and RCPT TO but nowhere
+// else.
+func ParseCmdUTF8(line string) ParsedLine {
+	return parseCmd(line, true)
+}
+
+func parseCmd(line string, utf8ok bool) ParsedLine {
 	var res ParsedLine
 	res.Cmd = BadCmd
 
-	// We're going to upper-case this, which may explode on us if this
-	// is UTF-8 or anything that smells like it.
-	if !isall7bit([]byte(line)) {
+	// Commands are supposed to be 7-bit ASCII. With SMTPUTF8 we
+	// allow UTF-8 in addresses, but it has to be valid UTF-8.
+	is7bit := isall7bit([]byte(line))
+	switch {
+	case !is7bit && !utf8ok:
 		res.Err = "command contains non 7-bit ASCII"
 		return res
+	case !is7bit && !utf8.ValidString(line):
+		res.Err = "command is not valid UTF-8"
+		return res
 	}
 
 	// Search in the command table for the prefix that matches. If
@@ -152,7 +204,7 @@ func ParseCmd(line string) ParsedLine {
 	// We search on an upper-case version of the line to make my life
 	// much easier.
 	found := -1
-	upper := strings.ToUpper(line)
+	upper := asciiUpper(line)
 	for i := range smtpCommand {
 		if strings.HasPrefix(upper, smtpCommand[i].text) {
 			found = i
@@ -163,6 +215,10 @@ func ParseCmd(line string) ParsedLine {
 		res.Err = "unrecognized command"
 		return res
 	}
+	if !is7bit && smtpCommand[found].argtype != colonAddress {
+		res.Err = "command contains non 7-bit ASCII"
+		return res
+	}
 
 	// Validate that we've ended at a word boundary, either a space or
 	// ':'. If we don't, this is not a valid match. Note that we now
@@ -210,29 +266,11 @@ func ParseCmd(line string) ParsedLine {
 			res.Err = "SMTP command requires an address"
 			return res
 		}
-		// We explicitly check for '>' at the end of the string
-		// to accept (at this point) 'MAIL FROM:<<...>>'. This will
-		// fail if people also supply ESMTP parameters, of course.
-		// Such is life.
-		// TODO: reject them here? Maybe it's simpler.
-		// BUG: this is imperfect because in theory I think you
-		// can embed a quoted '>' inside a valid address and so
-		// fool us. But I'm not putting a full RFC whatever address
-		// parser in here, thanks, so we'll reject those.
-		if line[llen-1] == '>' {
-			idx = llen - 1
-		} else {
-			idx = strings.IndexByte(line, '>')
-			if idx != -1 && line[idx+1] != ' ' {
-				res.Err = "improper argument formatting"
-				return res
-			}
-		}
 		// NOTE: the RFC is explicit that eg 'MAIL FROM: <addr...>'
 		// is not valid, ie there cannot be a space between the : and
 		// the '<'. Normally we'd refuse to accept it, but a few too
 		// many things invalidly generate it.
-		if line[clen] != ':' || idx == -1 {
+		if line[clen] != ':' {
 			res.Err = "improper argument formatting"
 			return res
 		}
@@ -244,10 +282,37 @@ func ParseCmd(line string) ParsedLine {
 			res.Err = "improper argument formatting"
 			return res
 		}
+		// A valid address is found by really parsing it, which
+		// copes with things like quoted '>'s. Otherwise we fall
+		// back to guessing where it ends; callers can tell from
+		// Addr being nil.
+		addr, n, err := parsePath(line[spos:])
+		switch {
+		case err == nil && (spos+n == llen || line[spos+n] == ' '):
+			idx = spos + n - 1
+			res.Addr = addr
+		case line[llen-1] == '>':
+			// We explicitly check for '>' at the end of the
+			// string to accept (at this point) 'MAIL
+			// FROM:<<...>>'. This will fail if people also
+			// supply ESMTP parameters, of course. Such is
+			// life.
+			idx = llen - 1
+		default:
+			idx = strings.IndexByte(line, '>')
+			if idx == -1 || line[idx+1] != ' ' {
+				res.Err = "improper argument formatting"
+				return res
+			}
+		}
 		res.Arg = line[spos+1 : idx]
 		// As a side effect of this we generously allow trailing
 		// whitespace after RCPT TO and MAIL FROM. You're welcome.
 		res.Params = strings.TrimSpace(line[idx+1 : llen])
+		if !is7bit && !isall7bit([]byte(res.Params)) {
+			res.Cmd = BadCmd
+			res.Err = "command contains non 7-bit ASCII"
+		}
 	}
 	return res
 }
@@ -267,6 +332,7 @@ const (
 	sMail
 	sRcpt
 	sData
+	sBdat // in the middle of a series of BDAT chunks
 	sQuit // QUIT received and ack'd, we're exiting.
 
 	// Synthetic state
@@ -281,6 +347,7 @@ var states = map[Command]struct {
 }{
 	HELO:     {sInitial | sHelo, sHelo},
 	EHLO:     {sInitial | sHelo, sHelo},
+	LHLO:     {sInitial | sHelo, sHelo},
 	MAILFROM: {sHelo, sMail},
 	RCPTTO:   {sMail | sRcpt, sRcpt},
 	DATA:     {sRcpt, sData},
@@ -289,21 +356,44 @@ var states = map[Command]struct {
 // Limits has the time and message limits for a Conn, as well as some
 // additional options.
 //
-// A Conn always accepts 'BODY=[7BIT|8BITMIME]' as the sole MAIL FROM
-// parameter, since it advertises support for 8BITMIME.
+// A Conn always accepts 'BODY=[7BIT|8BITMIME]' as a MAIL FROM
+// parameter, since it advertises support for 8BITMIME. If NoParams
+// is set, any other parameter is rejected; otherwise unknown
+// parameters are passed to the caller in EventInfo.Params.
+//
+// The per-session limits are not enforced if they are zero. RCPT TOs
+// beyond Rcpts in a transaction get a 452. Going over any of the
+// others gets a 421 and ends the session, and the ABORT event from
+// Next() says which limit it was. Lifetime is only checked while we
+// wait for commands.
 type Limits struct {
 	CmdInput time.Duration // client commands, eg MAIL FROM
 	MsgInput time.Duration // total time to get the email message itself
 	ReplyOut time.Duration // server replies to client commands
 	TLSSetup time.Duration // time limit to finish STARTTLS TLS setup
-	MsgSize  int64         // total size of an email message
+	MsgSize  int64         // total size of an email message (RFC 1870 style)
 	BadCmds  int           // how many unknown commands before abort
+	Verifies int           // how many VRFY and EXPN commands to answer
 	NoParams bool          // reject MAIL FROM/RCPT TO with parameters
+
+	// How much more of a too big message to read and throw away
+	// so that we can reply 552 to it instead of aborting.
+	MsgDiscard int64
+
+	// Per-session limits
+	Rcpts    int           // accepted RCPT TOs per transaction
+	Msgs     int           // messages received
+	Cmds     int           // commands of any sort
+	Noops    int           // NOOP commands
+	Rsets    int           // RSET commands
+	Lifetime time.Duration // total time of the session
 }
 
 // The default limits that are applied if you do not specify anything.
 // Two minutes for command input and command replies, ten minutes for
-// receiving messages, and 5 Mbytes of message size.
+// receiving messages, and 5 Mbytes of message size, with up to 20
+// Mbytes more of a too big message read and discarded. The
+// per-session limits are not enforced by default.
 //
 // Note that these limits are not necessarily RFC compliant, although
 // they should be enough for real email clients.
@@ -314,11 +404,95 @@ var DefaultLimits = Limits{
 	TLSSetup: 4 * time.Minute,
 	MsgSize:  5 * 1024 * 1024,
 	BadCmds:  5,
+	Verifies: 5,
 	NoParams: true,
+
+	MsgDiscard: 20 * 1024 * 1024,
 }
 
 // Config represents the configuration for a Conn. If unset, Limits is
 // DefaultLimits, LocalName is 'localhost', and SftName is 'go-smtpd'.
+//
+// If Chunking is set, a Conn advertises CHUNKING and BINARYMIME (RFC
+// 3030) and accepts BDAT as an alternative to DATA. Messages sent
+// with BDAT are delivered exactly as sent, with CR NL line endings.
+//
+// If SMTPUTF8 is set, a Conn advertises SMTPUTF8 (RFC 6531) and
+// accepts UTF-8 addresses in MAIL FROM and RCPT TO in transactions
+// that use the SMTPUTF8 MAIL FROM parameter. Otherwise commands must
+// be 7-bit ASCII.
+//
+// If DSN is set, a Conn advertises DSN (RFC 3461) and accepts and
+// checks the RET and ENVID MAIL FROM parameters and the NOTIFY and
+// ORCPT RCPT TO parameters. They are passed to the caller in
+// EventInfo.DSN.
+//
+// If RequireTLS is set, a Conn advertises REQUIRETLS (RFC 8689) once
+// TLS is on and accepts the REQUIRETLS MAIL FROM parameter then; a
+// REQUIRETLS MAIL FROM without TLS gets a 530. EventInfo.RequireTLS
+// says if the current transaction had it, in which case the message
+// must only be relayed onward over TLS.
+//
+// SMTP AUTH is supported only if Authenticator is set. The plaintext
+// PLAIN and LOGIN mechanisms are offered only after STARTTLS unless
+// AuthInsecure is set.
+//
+// If AddReceived is set, the message of every GOTDATA event starts
+// with a Received header from Conn.Received(), whose id is the Conn's
+// ID and the number of the message in the connection, eg '12.1'.
+//
+// If XClient or XForward are set, a Conn supports the Postfix XCLIENT
+// or XFORWARD extensions, but only for clients in XTrusted. After
+// XCLIENT, Conn.XClient has the client information, RemoteAddr()
+// and AuthUser reflect it, and the connection is back at its
+// greeting banner. After XFORWARD, Conn.XForward has the information
+// for the next mail transaction.
+//
+// VRFY and EXPN are answered only if Verifier is set, and then only
+// for the first Limits.Verifies of them in a session.
+//
+// If ImplicitTLS is set, the connection is TLS from the very start
+// (as for SMTP submission on port 465, per RFC 8314) and STARTTLS is
+// not offered. The TLS handshake is done before the greeting banner
+// and must succeed within Limits.TLSSetup; if it fails, the first
+// event is TLSERROR and the connection is aborted. ImplicitTLS
+// requires TLSConfig.
+//
+// If LMTP is set, the Conn speaks LMTP (RFC 2033) instead of SMTP:
+// clients must use LHLO instead of HELO or EHLO, and a received
+// message gets a separate reply for each accepted RCPT TO, in the
+// order they were given. The caller makes these replies by calling
+// Accept(), Reject(), Tempfail() or their variants once per
+// recipient for the GOTDATA event; Next() accepts any that are left.
+//
+// If ProxyProtocol is set, connections from ProxyTrusted sources
+// (which must not be empty, just as for XTrusted) must start with a
+// PROXY protocol header, which is read before any TLS handshake or
+// greeting banner. The Conn then reports the addresses from the
+// header as its RemoteAddr() and LocalAddr(). A bad or missing header
+// aborts the connection. See also ReadProxyHeader.
+//
+// If StreamData is set, GOTDATA events give the caller the message
+// as an io.Reader in EventInfo.Data instead of as a string in
+// EventInfo.Arg, so that large messages need never be held in
+// memory. The size and time limits are enforced as the message is
+// read, so a too big message gets no TOOBIG event (see Next()).
+//
+// BareEOL is what to do about bare CRs and LFs in commands and DATA
+// messages; see BarePolicy. With StreamData, a message is only
+// checked as it is read, so EventInfo.BareEOL is never set for it
+// and a message rejected under BareReject is only rejected when the
+// caller replies to it.
+//
+// If SpoolSize is set, a message larger than it is written to a
+// temporary file in SpoolDir (or the default directory for temporary
+// files, if SpoolDir is empty) as it is received, instead of being
+// kept in memory. Its GOTDATA event has it as a *Spool in
+// EventInfo.Data instead of as a string in EventInfo.Arg; smaller
+// messages are unaffected. This applies to messages from BDAT and,
+// unless StreamData is set, from DATA. If the message can't be
+// written out, the Conn gives it a '452 4.3.1' reply itself and
+// there is no GOTDATA event for it.
 type Config struct {
 	TLSConfig *tls.Config   // TLS configuration if TLS is to be enabled
 	Limits    *Limits       // The limits applied to the connection
@@ -327,16 +501,54 @@ type Config struct {
 	LocalName string        // The local hostname to use in messages
 	SftName   string        // The software name to use in messages
 	Announce  string        // extra stuff to announce in greeting banner
+	Chunking  bool          // support BDAT and BINARYMIME
+	SMTPUTF8  bool          // support SMTPUTF8
+	DSN       bool          // support DSN
+	// support REQUIRETLS, which is only advertised under TLS
+	RequireTLS bool
+	// deliver messages as a stream in EventInfo.Data
+	StreamData bool
+	// what to do about bare CRs and LFs
+	BareEOL BarePolicy
+
+	// TLS from the first byte, without STARTTLS
+	ImplicitTLS bool
+	// speak LMTP instead of SMTP
+	LMTP bool
+	// expect a PROXY protocol header from ProxyTrusted sources
+	ProxyProtocol bool
+	ProxyTrusted  []*net.IPNet
+
+	Authenticator Authenticator // checks SMTP AUTH credentials
+	AuthInsecure  bool          // offer PLAIN and LOGIN without TLS
+
+	Logger Logger // gets LogEvents, as well as any log writer
+
+	// prepend a Received header to messages; see Conn.Received()
+	AddReceived bool
+
+	// support XCLIENT and XFORWARD from XTrusted clients
+	XClient  bool
+	XForward bool
+	XTrusted []*net.IPNet
+
+	Verifier Verifier // answers VRFY and EXPN
+
+	// spool messages over SpoolSize bytes to files in SpoolDir
+	SpoolSize int64
+	SpoolDir  string
 }
 
-// Conn represents an ongoing SMTP connection. The TLS fields are
-// read-only.
+// Conn represents an ongoing SMTP connection. The TLS and AUTH fields
+// are read-only.
 //
 // Note that this structure cannot be created by hand. Call NewConn.
 //
-// Conn connections advertise support for PIPELINING, 8BITMIME, and
-// also STARTTLS if a TLS certificate has been added through
-// the Config passed to NewConn().
+// Conn connections advertise support for PIPELINING, 8BITMIME, SIZE,
+// ENHANCEDSTATUSCODES, and also STARTTLS if a TLS certificate has
+// been added through the Config passed to NewConn(). All replies
+// except the greeting banner, replies to EHLO/HELO, and the 354 and
+// 334 intermediate replies have RFC 3463 enhanced status codes.
 type Conn struct {
 	conn   net.Conn
 	lr     *io.LimitedReader // wraps conn as a reader
@@ -345,16 +557,88 @@ type Conn struct {
 
 	cfg Config
 
-	state   conState
-	badcmds int // count of bad commands so far
+	state    conState
+	badcmds  int // count of bad commands so far
+	verifies int // count of VRFY and EXPN commands so far
+
+	// Per-session limit tracking.
+	started time.Time
+	cmds    int
+	noops   int
+	rsets   int
+
+	aborted *AbortError // why we aborted, if we have
 
 	// used for state tracking for Accept()/Reject()/Tempfail().
 	curcmd  Command
+	curarg  string
 	replied bool
 	nstate  conState // next state if command is accepted.
 
-	TLSOn     bool   // TLS is on in this connection
-	TLSCipher uint16 // Negociated TLS cipher. See net/tls.
+	// For Received headers: the accepted HELO name and if it was
+	// EHLO or LHLO, the first accepted RCPT TO of the transaction,
+	// and how many messages we've received.
+	helo  string
+	esmtp bool
+	rcpt  string
+	nmsgs int
+
+	// BDAT state. binarymime is set by MAIL FROM and forbids DATA.
+	binarymime bool
+	smtputf8   bool // MAIL FROM had SMTPUTF8
+	requiretls bool // MAIL FROM had REQUIRETLS
+	chunks     *spooler
+	chunkstart time.Time
+
+	data   io.Reader // the current streamed message, if any
+	spool  *Spool    // the current spooled message, if any
+	toobig bool      // the current message was too big
+
+	// The PROXY protocol header of the connection, if any.
+	// Read-only.
+	Proxy *ProxyHeader
+
+	// Client information from XCLIENT and XFORWARD, if any.
+	// Read-only. XForward is for the current or next mail
+	// transaction and is forgotten after it.
+	XClient  *XClient
+	XForward *XForward
+	xfwdDone bool // XForward's transaction is over
+
+	// LMTP state. nrcpts is how many RCPT TOs have been accepted
+	// in this transaction, pending is how many post-DATA replies
+	// we still owe, and lmtpok is set if one of them accepted the
+	// message.
+	nrcpts  int
+	pending int
+	lmtpok  bool
+
+	// Server shutdown and context cancellation handling. idle is
+	// true while we wait for a command outside of a transaction;
+	// stopping is set by shutdown(); cancelled is the error of a
+	// cancelled NextContext() context. All are protected by smu,
+	// as are changes to conn.
+	smu       sync.Mutex
+	idle      bool
+	stopping  bool
+	cancelled error
+
+	// ID is unique for every Conn in this process. It is the
+	// ConnID of our LogEvents.
+	ID uint64
+
+	// BareEOLSeen is set if the current command or DATA message
+	// had bare CRs or LFs, which we only look for if
+	// Config.BareEOL is not BareAllow. Read-only.
+	BareEOLSeen bool
+
+	TLSOn      bool   // TLS is on in this connection
+	TLSCipher  uint16 // Negociated TLS cipher. See net/tls.
+	TLSVersion uint16 // Negociated TLS version. See net/tls.
+
+	// The identity that the client has authenticated as with
+	// SMTP AUTH, if any.
+	AuthUser string
 }
 
 // An Event is the sort of event that is returned by Conn.Next().
@@ -368,22 +652,47 @@ const (
 	DONE
 	ABORT
 	TLSERROR
+	TOOBIG
 )
 
 // EventInfo is what Conn.Next() returns to represent events.
-// Cmd and Arg come from ParsedLine.
+// Cmd and Arg come from ParsedLine. Params is set only for MAIL FROM
+// and RCPT TO commands with ESMTP parameters. SMTPUTF8 is set on
+// the MAIL FROM, RCPT TO, DATA, and GOTDATA events of a transaction
+// whose MAIL FROM had the SMTPUTF8 parameter, and RequireTLS on
+// those of one whose MAIL FROM had REQUIRETLS. DSN is set for MAIL
+// FROM and RCPT TO commands with DSN parameters if the Conn supports
+// DSN; each RCPT TO has its own. Addr is set for MAIL FROM and RCPT
+// TO commands whose address is a valid RFC 5321 Path; Conn passes
+// on commands with invalid addresses with Addr nil, leaving it to
+// the caller to decide what to do about them. Err is set on ABORT
+// events to an *AbortError that says why. BareEOL is set for
+// commands and messages with bare CRs or LFs if Config.BareEOL is
+// BareFlag.
+//
+// Data is set only on GOTDATA events of a Conn with StreamData set,
+// or for messages spooled to a file, which are a *Spool (see
+// Config.SpoolSize). For StreamData, it is the message, with
+// dot-stuffing and the terminating '.' removed. Data is only valid
+// until the next call to Accept(), Reject(), Tempfail(), their
+// variants, or Next(), which read and discard whatever of the
+// message the caller has not read. If the message is too large,
+// reads from Data fail with ErrMsgTooBig and the Conn replies 552 to
+// it when the caller replies (see TOOBIG). If it takes too long,
+// reads fail with ErrMsgTimeout. That aborts the connection, as does
+// any other read error, and Next() will then return ABORT.
 type EventInfo struct {
-	What Event
-	Cmd  Command
-	Arg  string
-}
-
-func (c *Conn) log(dir string, format string, elems ...interface{}) {
-	if c.logger == nil {
-		return
-	}
-	msg := fmt.Sprintf(format, elems...)
-	c.logger.Write([]byte(fmt.Sprintf("%s %s\n", dir, msg)))
+	What       Event
+	Cmd        Command
+	Arg        string
+	Params     Params
+	SMTPUTF8   bool
+	RequireTLS bool
+	BareEOL    bool
+	Err        error
+	DSN        *DSN
+	Addr       *Address
+	Data       io.Reader
 }
 
 // This assumes we're working with a non-Nagle connection. It may not work
@@ -404,25 +713,28 @@ func (c *Conn) slowWrite(b []byte) (n int, err error) {
 func (c *Conn) reply(format string, elems ...interface{}) {
 	var err error
 	s := fmt.Sprintf(format, elems...)
-	c.log("w", s)
+	c.logReply(s)
 	b := []byte(s + "\r\n")
 	// we can ignore the length returned, because Write()'s contract
 	// is that it returns a non-nil err if n < len(b).
 	// We are cautious about our write deadline.
 	wd := c.cfg.Delay * time.Duration(len(b))
-	c.conn.SetWriteDeadline(time.Now().Add(c.cfg.Limits.ReplyOut + wd))
+	c.setWriteDeadline(time.Now().Add(c.cfg.Limits.ReplyOut + wd))
 	if c.cfg.Delay > 0 {
 		_, err = c.slowWrite(b)
 	} else {
 		_, err = c.conn.Write(b)
 	}
 	if err != nil {
-		c.log("!", "reply abort: %v", err)
-		c.state = sAbort
+		c.logErr(err, true, "reply abort: %v", err)
+		c.abort(AbortWriteError, err, 0)
 	}
 }
 
-func (c *Conn) replyMulti(code int, format string, elems ...interface{}) {
+// replyMulti writes a reply that may be multi-line. If enh is not
+// empty it is the RFC 2034 enhanced status code, which goes on every
+// line.
+func (c *Conn) replyMulti(code int, enh string, format string, elems ...interface{}) {
 	rs := strings.Trim(fmt.Sprintf(format, elems...), " \t\n")
 	sl := strings.Split(rs, "\n")
 	cont := '-'
@@ -430,13 +742,45 @@ func (c *Conn) replyMulti(code int, format string, elems ...interface{}) {
 		if i == len(sl)-1 {
 			cont = ' '
 		}
-		c.reply("%3d%c%s", code, cont, sl[i])
+		if enh != "" {
+			c.reply("%3d%c%s %s", code, cont, enh, sl[i])
+		} else {
+			c.reply("%3d%c%s", code, cont, sl[i])
+		}
 		if c.state == sAbort {
 			break
 		}
 	}
 }
 
+// validEnhanced returns true if enh is a syntactically valid RFC 3463
+// enhanced status code whose class matches the reply code.
+func validEnhanced(code int, enh string) bool {
+	p := strings.Split(enh, ".")
+	if len(p) != 3 || p[0] != strconv.Itoa(code/100) {
+		return false
+	}
+	for _, n := range p[1:] {
+		if len(n) == 0 || len(n) > 3 {
+			return false
+		}
+		for i := range n {
+			if n[i] < '0' || n[i] > '9' {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// enhOr returns enh if it is valid for code and def otherwise.
+func enhOr(code int, enh, def string) string {
+	if validEnhanced(code, enh) {
+		return enh
+	}
+	return def
+}
+
 func fmtBytesLeft(max, cur int64) string {
 	if cur == 0 {
 		return "0 bytes left"
@@ -447,75 +791,550 @@ func fmtBytesLeft(max, cur int64) string {
 func (c *Conn) readCmd() string {
 	// This is much bigger than the RFC requires.
 	c.lr.N = 2048
-	// Allow two minutes per command.
-	c.conn.SetReadDeadline(time.Now().Add(c.cfg.Limits.CmdInput))
-	line, err := c.rdr.ReadLine()
+	// Allow two minutes per command, or what's left of the
+	// session if that's less.
+	limit := c.cfg.Limits.CmdInput
+	left := c.sessionLeft()
+	if left == 0 {
+		c.endSession("session too long")
+		return ""
+	}
+	if left > 0 && left < limit {
+		limit = left
+	}
+	c.setReadDeadline(time.Now().Add(limit))
+	// We're idle if we're not in the middle of a transaction. The
+	// read deadline must be set before we declare ourselves idle,
+	// so that shutdown() can override it.
+	if c.state&(sInitial|sHelo) != 0 && !c.setIdle(true) {
+		c.shutdownReply(ErrServerClosed)
+		return ""
+	}
+	line, err := c.readLine()
+	if c.state&(sInitial|sHelo) != 0 && !c.setIdle(false) {
+		c.shutdownReply(ErrServerClosed)
+		return ""
+	}
+	if ne, ok := err.(net.Error); ok && ne.Timeout() && c.sessionLeft() == 0 {
+		c.endSession("session too long")
+		return ""
+	}
 	// abort not just on errors but if the line length is exhausted.
 	if err != nil || c.lr.N == 0 {
-		c.state = sAbort
+		c.lineAbort(err, 2048)
 		line = ""
-		c.log("!", "command abort %s err: %v",
+		c.logErr(err, true, "command abort %s err: %v",
 			fmtBytesLeft(2048, c.lr.N), err)
-	} else {
-		c.log("r", line)
 	}
 	return line
 }
 
-func (c *Conn) readData() string {
-	c.conn.SetReadDeadline(time.Now().Add(c.cfg.Limits.MsgInput))
-	c.lr.N = c.cfg.Limits.MsgSize
-	b, err := c.rdr.ReadDotBytes()
-	if err != nil || c.lr.N == 0 {
-		c.state = sAbort
-		b = nil
-		c.log("!", "DATA abort %s err: %v",
-			fmtBytesLeft(c.cfg.Limits.MsgSize, c.lr.N), err)
+// ErrMsgTooBig is returned by reads from EventInfo.Data if the
+// message is larger than Limits.MsgSize.
+var ErrMsgTooBig = errors.New("message too big")
+
+// ErrMsgTimeout is returned by reads from EventInfo.Data if the
+// message was not all received within Limits.MsgInput.
+var ErrMsgTimeout = errors.New("message timeout")
+
+// dataReader reads a DATA message from the client, enforcing our
+// limits as it goes. It counts the message size the way RFC 1870
+// does, which is with CR NL line endings but without the
+// dot-stuffing or the terminating '.'. Our DotReader gives us bare
+// NLs, so we count each of them twice.
+//
+// Any error other than io.EOF aborts the connection. Errors are
+// sticky.
+type dataReader struct {
+	c      *Conn
+	r      io.Reader
+	size   int64
+	rawmax int64
+	err    error
+}
+
+func (c *Conn) newDataReader() *dataReader {
+	c.setReadDeadline(time.Now().Add(c.cfg.Limits.MsgInput))
+	// The raw limit is only a backstop; the real size check is
+	// done by counting. Dot-stuffing adds at most one byte to
+	// every line of at least two (counted) bytes, so a message
+	// that is within MsgSize is always within this, including
+	// some slop for the terminating '.' and bufio read-ahead.
+	c.toobig = false
+	d := &dataReader{c: c, r: c.newDotReader()}
+	d.rawmax = c.cfg.Limits.MsgSize + c.cfg.Limits.MsgSize/2 + 4096
+	c.lr.N = d.rawmax
+	return d
+}
+
+func (d *dataReader) Read(b []byte) (int, error) {
+	if d.err != nil {
+		return 0, d.err
+	}
+	n, err := d.r.Read(b)
+	d.size += int64(n + bytes.Count(b[:n], []byte{'\n'}))
+	if d.size > d.c.cfg.Limits.MsgSize || d.c.lr.N == 0 {
+		n, err = 0, ErrMsgTooBig
+	}
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		err = ErrMsgTimeout
+	}
+	if err == ErrMsgTooBig {
+		// If we can't find the end of the message, what stopped
+		// us is why we abort.
+		if err = d.discard(); err == nil {
+			d.err = ErrMsgTooBig
+			return n, d.err
+		}
+	}
+	switch err {
+	case nil:
+	case io.EOF:
+		d.c.log(LogRead, ". <end of data>")
+		d.err = err
+	default:
+		switch err {
+		case ErrMsgTooBig:
+			d.c.abort(AbortMsgTooBig, err, d.size)
+		case ErrMsgTimeout:
+			d.c.abort(AbortMsgTimeout, err, d.size)
+		default:
+			d.c.abort(readReason(err), err, d.size)
+		}
+		d.c.logErr(err, true, "DATA abort %s (%d message bytes) err: %v",
+			fmtBytesLeft(d.rawmax, d.c.lr.N), d.size, err)
+		d.err = err
+	}
+	return n, err
+}
+
+// discard reads and discards the rest of a message that is too big,
+// up to Limits.MsgDiscard more of it. It returns nil if it found the
+// end of the message, ErrMsgTooBig if there was too much of it, and
+// otherwise the error that stopped it.
+func (d *dataReader) discard() error {
+	max := d.c.cfg.Limits.MsgDiscard
+	if max <= 0 {
+		return ErrMsgTooBig
+	}
+	d.c.lr.N = max
+	n, err := io.Copy(io.Discard, d.r)
+	if d.c.lr.N == 0 {
+		err = ErrMsgTooBig
+	}
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		err = ErrMsgTimeout
+	}
+	if err != nil {
+		d.c.log(LogError, "DATA too big; could not discard it all (%d bytes discarded) err: %v", n, err)
+		return err
+	}
+	d.c.log(LogError, "DATA too big; discarded %d message bytes and %s", d.size, fmtBytesLeft(max, d.c.lr.N))
+	d.c.log(LogRead, ". <end of data>")
+	d.c.toobig = true
+	return nil
+}
+
+// replyTooBig replies to a message that was too big, once for every
+// recipient for LMTP, and ends the transaction.
+func (c *Conn) replyTooBig() {
+	for !c.replied && c.state != sAbort {
+		c.reply("552 5.3.4 Message too big")
+		c.replyDone()
+	}
+	if c.state == sPostData {
+		c.state = sHelo
+	}
+}
+
+// readData reads a DATA message. It is returned as a Spool instead
+// of a string if it was spooled to a file; the error is from trying
+// to do that.
+func (c *Conn) readData() (string, *Spool, error) {
+	s := c.newSpooler()
+	defer s.discard()
+	if _, err := io.Copy(s, c.newDataReader()); err != nil {
+		return "", nil, nil
+	}
+	sp, err := s.spool()
+	return s.String(), sp, err
+}
+
+// finishData reads and discards any part of a streamed message that
+// our caller has not read, since we can't reply to the client until
+// it has sent the whole message. It returns false if the message
+// could not be read, in which case the connection is being aborted
+// and there is no point in replying, or if we have rejected it
+// ourselves for being too big or for bare CRs or LFs.
+func (c *Conn) finishData() bool {
+	if c.data == nil {
+		return true
+	}
+	io.Copy(io.Discard, c.data)
+	c.data = nil
+	if c.state == sAbort {
+		c.replied = true
+		return false
+	}
+	if c.toobig {
+		c.replyTooBig()
+		return false
+	}
+	return !c.rejectBare()
+}
+
+// readChunk handles a BDAT command, reading its chunk of data. It
+// returns true if this was the LAST chunk of a good message, in which
+// case the whole message is ready in c.chunks.
+//
+// Per RFC 3030 we must read the chunk even if we are going to reject
+// the BDAT, since otherwise we would lose sync with the client.
+func (c *Conn) readChunk(arg string) bool {
+	var last bool
+	f := strings.Fields(arg)
+	size, err := strconv.ParseInt(f[0], 10, 64)
+	if len(f) == 2 && strings.ToUpper(f[1]) == "LAST" {
+		last = true
+	}
+	if err != nil || size < 0 || len(f) > 2 || (len(f) == 2 && !last) {
+		// We have no idea how much data follows, so we can't
+		// go on.
+		c.reply("501 5.5.4 Bad BDAT command")
+		c.abort(AbortBadCmds, errors.New("bad BDAT command"), 0)
+		return false
+	}
+
+	good := c.state&(sRcpt|sBdat) != 0
+	if c.state == sRcpt {
+		c.chunks.discard()
+		c.chunks = c.newSpooler()
+		c.chunkstart = time.Now()
+	}
+	tooBig := good && c.chunks.Len()+size > c.cfg.Limits.MsgSize
+
+	// All chunks of a good message together must arrive within
+	// MsgInput. A chunk we are only going to throw away gets
+	// MsgInput on its own, and like the rest of a too big DATA
+	// message, we only read so much of it.
+	if good {
+		c.setReadDeadline(c.chunkstart.Add(c.cfg.Limits.MsgInput))
 	} else {
-		c.log("r", ". <end of data>")
+		c.setReadDeadline(time.Now().Add(c.cfg.Limits.MsgInput))
 	}
-	return string(b)
+	if (!good || tooBig) && size > c.cfg.Limits.MsgDiscard {
+		err = errors.New("BDAT chunk too big to discard")
+		c.logErr(err, true, "BDAT abort: %d byte chunk too big to discard", size)
+		c.abort(AbortMsgTooBig, err, 0)
+		return false
+	}
+	// Allow for bufio read-ahead past the chunk.
+	c.lr.N = size + 4096
+	if good && !tooBig {
+		_, err = io.CopyN(c.chunks, c.rdr.R, size)
+	} else {
+		_, err = io.CopyN(io.Discard, c.rdr.R, size)
+	}
+	if err != nil {
+		c.abort(readReason(err), err, size+4096-c.lr.N)
+		c.logErr(err, true, "BDAT abort %s err: %v",
+			fmtBytesLeft(size+4096, c.lr.N), err)
+		return false
+	}
+	c.log(LogRead, "<BDAT chunk of %d bytes>", size)
+
+	switch {
+	case !good:
+		c.reply("503 5.5.1 Out of sequence command")
+		return false
+	case tooBig:
+		// The transaction has failed.
+		c.chunks.discard()
+		c.state = sHelo
+		c.reply("552 5.3.4 Message size exceeds fixed maximum message size")
+		return false
+	case !last:
+		c.state = sBdat
+		c.reply("250 2.0.0 %d octets received", size)
+		return false
+	}
+	return true
+}
+
+// readProxy reads a PROXY protocol header from our connection if it
+// is from a trusted proxy. If this fails, we abort.
+func (c *Conn) readProxy() {
+	nc, err := ReadProxyHeader(c.conn, c.cfg.ProxyTrusted, c.cfg.Limits.CmdInput)
+	if err != nil {
+		c.logErr(err, true, "%v from %v", err, c.conn.RemoteAddr())
+		c.abort(AbortProxy, err, 0)
+		return
+	}
+	if pc, ok := nc.(*ProxyConn); ok {
+		c.Proxy = pc.Header
+		c.setupConn(nc)
+	}
+}
+
+// RemoteAddr returns the address of the client, which comes from
+// XCLIENT or the PROXY protocol header if there was either.
+func (c *Conn) RemoteAddr() net.Addr {
+	if c.XClient != nil && c.XClient.Addr != nil {
+		return &net.TCPAddr{IP: c.XClient.Addr, Port: c.XClient.Port}
+	}
+	return c.conn.RemoteAddr()
+}
+
+// LocalAddr returns the address that the client connected to, which
+// comes from the PROXY protocol header if there was one.
+func (c *Conn) LocalAddr() net.Addr {
+	return c.conn.LocalAddr()
+}
+
+// startTLS does the TLS handshake on our connection and switches us
+// to using TLS. If it fails, the connection is aborted.
+func (c *Conn) startTLS() error {
+	if c.cfg.TLSConfig == nil {
+		err := errors.New("no TLS configuration")
+		c.abort(AbortTLS, err, 0)
+		return err
+	}
+	// Since we're about to start chattering on conn outside of
+	// our normal framework, we must reset both read and write
+	// timeouts to our TLS setup timeout.
+	c.setReadDeadline(time.Now().Add(c.cfg.Limits.TLSSetup))
+	c.setWriteDeadline(time.Now().Add(c.cfg.Limits.TLSSetup))
+	tlsConn := tls.Server(c.conn, c.cfg.TLSConfig)
+	err := tlsConn.Handshake()
+	if err != nil {
+		c.logErr(err, true, "TLS setup failed: %v", err)
+		c.abort(AbortTLS, err, 0)
+		return err
+	}
+	// With TLS set up, we now want no read and write deadlines
+	// on the underlying connection. So cancel all deadlines by
+	// providing a zero value.
+	c.setReadDeadline(time.Time{})
+	// switch c.conn to tlsConn.
+	c.setupConn(tlsConn)
+	c.TLSOn = true
+	cs := tlsConn.ConnectionState()
+	c.log(LogError, "TLS negociated with cipher 0x%04x", cs.CipherSuite)
+	c.TLSCipher = cs.CipherSuite
+	c.TLSVersion = cs.Version
+	return nil
+}
+
+// setReadDeadline and setWriteDeadline set our IO deadlines, unless
+// we have been cancelled, in which case all IO must fail at once.
+func (c *Conn) setReadDeadline(t time.Time) {
+	c.smu.Lock()
+	defer c.smu.Unlock()
+	if c.cancelled != nil {
+		t = time.Now()
+	}
+	c.conn.SetReadDeadline(t)
+}
+
+func (c *Conn) setWriteDeadline(t time.Time) {
+	c.smu.Lock()
+	defer c.smu.Unlock()
+	if c.cancelled != nil {
+		t = time.Now()
+	}
+	c.conn.SetWriteDeadline(t)
+}
+
+// cancel makes all current and future IO fail because of err.
+func (c *Conn) cancel(err error) {
+	c.smu.Lock()
+	defer c.smu.Unlock()
+	c.cancelled = err
+	c.conn.SetDeadline(time.Now())
+}
+
+// uncancel undoes cancel(), returning its error if there was one.
+func (c *Conn) uncancel() error {
+	c.smu.Lock()
+	defer c.smu.Unlock()
+	err := c.cancelled
+	c.cancelled = nil
+	return err
+}
+
+// setIdle sets whether or not we are idle. It returns false if we
+// are being shut down.
+func (c *Conn) setIdle(idle bool) bool {
+	c.smu.Lock()
+	defer c.smu.Unlock()
+	c.idle = idle
+	return !c.stopping
+}
+
+// shutdown asks the connection to close down the next time it is
+// idle, and kicks it out of any idle command read.
+func (c *Conn) shutdown() {
+	c.smu.Lock()
+	defer c.smu.Unlock()
+	c.stopping = true
+	if c.idle {
+		c.conn.SetReadDeadline(time.Now())
+	}
+}
+
+// shutdownReply tells the client that we are going away because of
+// err, and aborts.
+func (c *Conn) shutdownReply(err error) {
+	c.logErr(err, true, "%v", err)
+	c.reply("421 4.3.2 %s Service shutting down", c.cfg.LocalName)
+	// Shutting down is why any read failed.
+	c.aborted = nil
+	c.abort(AbortShutdown, err, 0)
+}
+
+// overLimit ends the session with a 421 if n is over the per-session
+// limit max, which is not enforced if it is zero. It returns true if
+// it did.
+func (c *Conn) overLimit(n, max int, why string) bool {
+	if max == 0 || n <= max {
+		return false
+	}
+	c.endSession(why)
+	return true
+}
+
+// endSession ends the session because it went over a per-session
+// limit.
+func (c *Conn) endSession(why string) {
+	c.logErr(nil, true, "session limit: %s", why)
+	c.reply("421 4.7.0 %s Session limit exceeded: %s", c.cfg.LocalName, why)
+	c.abort(AbortLimit, errors.New(why), 0)
+	c.replied = true
+}
+
+// sessionLeft returns how much time the session has left under
+// Limits.Lifetime, or -1 if it is unlimited.
+func (c *Conn) sessionLeft() time.Duration {
+	if c.cfg.Limits.Lifetime == 0 {
+		return -1
+	}
+	if left := time.Until(c.started.Add(c.cfg.Limits.Lifetime)); left > 0 {
+		return left
+	}
+	return 0
 }
 
 func (c *Conn) stopme() bool {
 	return c.state == sAbort || c.badcmds > c.cfg.Limits.BadCmds || c.state == sQuit
 }
 
+// advance moves us to our next state when the current command is
+// accepted. An LMTP message only moves on once every recipient has
+// had its reply, but one accepted recipient is enough for it to
+// have succeeded.
+func (c *Conn) advance() {
+	switch c.curcmd {
+	case HELO, EHLO, LHLO:
+		c.helo = c.curarg
+		c.esmtp = c.curcmd != HELO
+	case RCPTTO:
+		c.nrcpts++
+		if c.nrcpts == 1 {
+			c.rcpt = c.curarg
+		}
+	}
+	if c.pending > 1 {
+		c.lmtpok = true
+		return
+	}
+	if c.state != sAbort {
+		c.state = c.nstate
+	}
+}
+
+// replyDone records that we have replied to the current command.
+// An LMTP message needs a reply for each accepted recipient, so it
+// is only done after the last of them.
+func (c *Conn) replyDone() {
+	if c.pending > 1 {
+		c.pending--
+		return
+	}
+	if c.pending == 1 && c.lmtpok && c.state != sAbort {
+		c.state = c.nstate
+	}
+	c.pending = 0
+	c.lmtpok = false
+	c.replied = true
+}
+
+// startPostData sets us up to reply to a message that we have just
+// received (or started streaming).
+func (c *Conn) startPostData() {
+	c.replied = false
+	c.state = sPostData
+	c.nstate = sHelo
+	c.nmsgs++
+	c.xforwardDone()
+	if c.cfg.LMTP {
+		c.pending = c.nrcpts
+	}
+}
+
 // Accept accepts the current SMTP command, ie gives an appropriate
 // 2xx reply to the client.
 func (c *Conn) Accept() {
-	if c.replied {
+	if c.replied || !c.finishData() {
 		return
 	}
 	oldstate := c.state
-	c.state = c.nstate
+	c.advance()
 	switch c.curcmd {
 	case HELO:
-		c.reply("250 %s Hello %v", c.cfg.LocalName, c.conn.RemoteAddr())
-	case EHLO:
-		c.reply("250-%s Hello %v", c.cfg.LocalName, c.conn.RemoteAddr())
+		c.reply("250 %s Hello %v", c.cfg.LocalName, c.RemoteAddr())
+	case EHLO, LHLO:
+		c.reply("250-%s Hello %v", c.cfg.LocalName, c.RemoteAddr())
 		// We advertise 8BITMIME per
 		// http://cr.yp.to/smtp/8bitmime.html
 		c.reply("250-8BITMIME")
 		c.reply("250-PIPELINING")
+		c.reply("250-ENHANCEDSTATUSCODES")
+		// RFC 1870. Our size limit is counted the RFC 1870
+		// way (see dataReader) and we 552 too-large SIZE=
+		// parameters on MAIL FROM in checkParams().
+		c.reply("250-SIZE %d", c.cfg.Limits.MsgSize)
 		// STARTTLS RFC says: MUST NOT advertise STARTTLS
 		// after TLS is on.
 		if c.cfg.TLSConfig != nil && !c.TLSOn {
 			c.reply("250-STARTTLS")
 		}
-		// We do not advertise SIZE because our size limits
-		// are different from the size limits that RFC 1870
-		// wants us to use. We impose a flat byte limit while
-		// RFC 1870 wants us to not count quoted dots.
-		// Advertising SIZE would also require us to parse
-		// SIZE=... on MAIL FROM in order to 552 any too-large
-		// sizes.
-		// On the whole: pass. Cannot implement.
-		// (In general SIZE is hella annoying if you read the
-		// RFC religiously.)
+		if c.cfg.Chunking {
+			c.reply("250-CHUNKING")
+			c.reply("250-BINARYMIME")
+		}
+		if c.cfg.SMTPUTF8 {
+			c.reply("250-SMTPUTF8")
+		}
+		if c.cfg.DSN {
+			c.reply("250-DSN")
+		}
+		// RFC 8689 section 4.1: only over TLS.
+		if c.cfg.RequireTLS && c.TLSOn {
+			c.reply("250-REQUIRETLS")
+		}
+		if mechs := c.authMechs(); len(mechs) > 0 {
+			c.reply("250-AUTH %s", strings.Join(mechs, " "))
+		}
+		if c.cfg.XClient && c.xTrusted() {
+			c.reply("250-XCLIENT %s", xclientAttrs)
+		}
+		if c.cfg.XForward && c.xTrusted() {
+			c.reply("250-XFORWARD %s", xforwardAttrs)
+		}
 		c.reply("250 HELP")
-	case MAILFROM, RCPTTO:
-		c.reply("250 Okay, I'll believe you for now")
+	case MAILFROM:
+		c.reply("250 2.1.0 Okay, I'll believe you for now")
+	case RCPTTO:
+		c.reply("250 2.1.5 Okay, I'll believe you for now")
 	case DATA:
 		// c.curcmd == DATA both when we've received the
 		// initial DATA and when we've actually received the
@@ -524,10 +1343,10 @@ func (c *Conn) Accept() {
 		if oldstate == sRcpt {
 			c.reply("354 Send away")
 		} else {
-			c.reply("250 I've put it in a can")
+			c.reply("250 2.0.0 I've put it in a can")
 		}
 	}
-	c.replied = true
+	c.replyDone()
 }
 
 // AcceptMsg accepts MAIL FROM, RCPT TO, DATA, or message bodies with
@@ -536,74 +1355,103 @@ func (c *Conn) Accept() {
 // This cannot be applied to EHLO/HELO messages; if called for one
 // of them, it is equivalent to Accept().
 func (c *Conn) AcceptMsg(format string, elems ...interface{}) {
-	if c.curcmd == HELO || c.curcmd == EHLO || c.replied {
+	c.AcceptMsgEnhanced("", format, elems...)
+}
+
+// AcceptMsgEnhanced is AcceptMsg with a RFC 3463 enhanced status code
+// that you supply, such as "2.1.5". If enh is empty or is not a
+// valid 2.X.Y code, a default code is used. The 354 reply to DATA
+// has no enhanced status code.
+func (c *Conn) AcceptMsgEnhanced(enh string, format string, elems ...interface{}) {
+	if c.curcmd == HELO || c.curcmd == EHLO || c.curcmd == LHLO || c.replied {
 		// We can't apply to EHLO/HELO because those have
 		// special formatting requirements, especially EHLO.
 		c.Accept()
 		return
 	}
+	if !c.finishData() {
+		return
+	}
 	oldstate := c.state
-	c.state = c.nstate
+	c.advance()
 	switch c.curcmd {
-	case MAILFROM, RCPTTO:
-		c.replyMulti(250, format, elems...)
+	case MAILFROM:
+		c.replyMulti(250, enhOr(250, enh, "2.1.0"), format, elems...)
+	case RCPTTO:
+		c.replyMulti(250, enhOr(250, enh, "2.1.5"), format, elems...)
 	case DATA:
 		if oldstate == sRcpt {
-			c.replyMulti(354, format, elems...)
+			c.replyMulti(354, "", format, elems...)
 		} else {
-			c.replyMulti(250, format, elems...)
+			c.replyMulti(250, enhOr(250, enh, "2.0.0"), format, elems...)
 		}
 	}
-	c.replied = true
+	c.replyDone()
 }
 
 // AcceptData accepts a message (ie, a post-DATA blob) with an ID that
 // is reported to the client in the 2xx message. It only does anything
 // when the Conn needs to reply to a DATA blob.
 func (c *Conn) AcceptData(id string) {
-	if c.replied || c.curcmd != DATA || c.state != sPostData {
+	if c.replied || c.curcmd != DATA || c.state != sPostData || !c.finishData() {
 		return
 	}
-	c.state = c.nstate
-	c.reply("250 I've put it in a can called %s", id)
-	c.replied = true
+	c.advance()
+	c.reply("250 2.0.0 I've put it in a can called %s", id)
+	c.replyDone()
 }
 
 // RejectData rejects a message with an ID that is reported to the client
 // in the 5xx message.
 func (c *Conn) RejectData(id string) {
-	if c.replied || c.curcmd != DATA || c.state != sPostData {
+	if c.replied || c.curcmd != DATA || c.state != sPostData || !c.finishData() {
 		return
 	}
-	c.reply("554 Not put in a can called %s", id)
-	c.replied = true
+	c.reply("554 5.7.1 Not put in a can called %s", id)
+	c.replyDone()
 }
 
 // Reject rejects the curent SMTP command, ie gives the client an
 // appropriate 5xx message.
 func (c *Conn) Reject() {
+	if !c.finishData() {
+		return
+	}
 	switch c.curcmd {
-	case HELO, EHLO:
+	case HELO, EHLO, LHLO:
 		c.reply("550 Not accepted")
 	case MAILFROM, RCPTTO:
-		c.reply("550 Bad address")
+		c.reply("550 5.1.0 Bad address")
 	case DATA:
-		c.reply("554 Not accepted")
+		c.reply("554 5.7.1 Not accepted")
 	}
-	c.replied = true
+	c.replyDone()
 }
 
 // RejectMsg rejects the current SMTP command with the fmt.Printf
 // style message that you supply. The generated message may include
 // embedded newlines for a multi-line reply.
 func (c *Conn) RejectMsg(format string, elems ...interface{}) {
+	c.RejectMsgEnhanced("", format, elems...)
+}
+
+// RejectMsgEnhanced is RejectMsg with a RFC 3463 enhanced status code
+// that you supply, such as "5.7.1". If enh is empty or is not a valid
+// 5.X.Y code, a default code is used. Replies to EHLO/HELO never have
+// enhanced status codes.
+func (c *Conn) RejectMsgEnhanced(enh string, format string, elems ...interface{}) {
+	if !c.finishData() {
+		return
+	}
 	switch c.curcmd {
-	case HELO, EHLO, MAILFROM, RCPTTO:
-		c.replyMulti(550, format, elems...)
+	case HELO, EHLO, LHLO:
+		c.replyMulti(550, "", format, elems...)
+	case MAILFROM, RCPTTO:
+		c.replyMulti(550, enhOr(550, enh, "5.7.1"), format, elems...)
 	case DATA:
-		c.replyMulti(554, format, elems...)
+		c.replyMulti(554, enhOr(554, enh, "5.7.1"), format, elems...)
 	}
-	c.replied = true
+	c.replyDone()
 }
 
 // TempfailMsg temporarily rejects the current SMTP command with
@@ -611,43 +1459,210 @@ func (c *Conn) RejectMsg(format string, elems ...interface{}) {
 // The generated message may include embedded newlines for a
 // multi-line reply.
 func (c *Conn) TempfailMsg(format string, elems ...interface{}) {
+	c.TempfailMsgEnhanced("", format, elems...)
+}
+
+// TempfailMsgEnhanced is TempfailMsg with a RFC 3463 enhanced status
+// code that you supply, such as "4.7.1". If enh is empty or is not a
+// valid 4.X.Y code, a default code is used. Replies to EHLO/HELO never
+// have enhanced status codes.
+func (c *Conn) TempfailMsgEnhanced(enh string, format string, elems ...interface{}) {
+	if !c.finishData() {
+		return
+	}
 	switch c.curcmd {
-	case HELO, EHLO:
-		c.replyMulti(421, format, elems...)
+	case HELO, EHLO, LHLO:
+		c.replyMulti(421, "", format, elems...)
 	case MAILFROM, RCPTTO, DATA:
-		c.replyMulti(450, format, elems...)
+		c.replyMulti(450, enhOr(450, enh, "4.3.0"), format, elems...)
 	}
-	c.replied = true
+	c.replyDone()
 }
 
 // Tempfail temporarily rejects the current SMTP command, ie it gives
 // the client an appropriate 4xx reply. Properly implemented clients
 // will retry temporary failures later.
 func (c *Conn) Tempfail() {
+	if !c.finishData() {
+		return
+	}
 	switch c.curcmd {
-	case HELO, EHLO:
+	case HELO, EHLO, LHLO:
 		c.reply("421 Not available now")
 	case MAILFROM, RCPTTO, DATA:
-		c.reply("450 Not available")
+		c.reply("450 4.3.0 Not available")
 	}
-	c.replied = true
+	c.replyDone()
+}
+
+// Reply replies to the current SMTP command with the code and the
+// fmt.Printf style message that you supply, which may include
+// embedded newlines for a multi-line reply. enh is the RFC 3463
+// enhanced status code; it may be empty, but otherwise it must be
+// valid for code. Replies to EHLO/HELO and 354 replies never have
+// enhanced status codes, so enh is ignored for them.
+//
+// The code must be one that RFC 5321 allows for the command:
+//
+//	HELO, EHLO, LHLO	4xx or 5xx (use Accept() to accept them)
+//	MAIL FROM		250, 4xx, or 5xx
+//	RCPT TO			250, 251, 4xx, or 5xx
+//	DATA			354, 4xx, or 5xx
+//	the message		250, 4xx, or 5xx
+//
+// A 2xx or 354 reply accepts the command and a 4xx or 5xx one
+// rejects it, just as Accept() and Reject() or Tempfail() do. A 421
+// reply also closes the connection, as RFC 5321 requires, so the
+// next Next() will return ABORT; for LMTP, it is the reply for all
+// of the recipients of the message. Reply returns an error and does
+// nothing if the code or enh is not valid or if the command has
+// already been replied to.
+func (c *Conn) Reply(code int, enh string, format string, elems ...interface{}) error {
+	if err := c.checkReply(code, enh); err != nil {
+		return err
+	}
+	if !c.finishData() {
+		// We have already replied to the message ourselves.
+		return errors.New("message already replied to")
+	}
+	if code < 400 {
+		c.advance()
+	}
+	if c.noEnhanced(code) {
+		enh = ""
+	}
+	c.replyMulti(code, enh, format, elems...)
+	c.replyDone()
+	if code == 421 && c.state != sAbort {
+		c.logErr(nil, true, "closing after 421 reply")
+		c.abort(AbortClosed, nil, 0)
+	}
+	if c.state == sAbort {
+		// Nothing more goes to the client, including replies
+		// for any other LMTP recipients.
+		c.pending = 0
+		c.replied = true
+	}
+	return nil
+}
+
+// checkReply returns an error if code and enh are not a valid reply
+// to the current command.
+func (c *Conn) checkReply(code int, enh string) error {
+	if c.replied || c.curcmd == noCmd {
+		return errors.New("no command to reply to")
+	}
+	var ok bool
+	switch {
+	case code < 200 || code > 599 || (code/10)%10 > 5:
+	case code >= 400:
+		ok = true
+	case c.curcmd == MAILFROM:
+		ok = code == 250
+	case c.curcmd == RCPTTO:
+		ok = code == 250 || code == 251
+	case c.curcmd == DATA && c.state == sRcpt:
+		ok = code == 354
+	case c.curcmd == DATA:
+		ok = code == 250
+	}
+	if !ok {
+		return fmt.Errorf("reply code %d not valid for %s", code, cmdName(c.curcmd))
+	}
+	if enh != "" && !c.noEnhanced(code) && !validEnhanced(code, enh) {
+		return fmt.Errorf("enhanced status code '%s' not valid for reply code %d", enh, code)
+	}
+	return nil
+}
+
+// noEnhanced returns true if a code reply to the current command
+// never has an enhanced status code.
+func (c *Conn) noEnhanced(code int) bool {
+	return c.curcmd == HELO || c.curcmd == EHLO || c.curcmd == LHLO || code == 354
+}
+
+// checkParams() checks the parsed parameters of a MAIL FROM or RCPT
+// TO against what we advertise. It returns the reply to give if the
+// command must be refused, or "" if the parameters are acceptable.
+func (c *Conn) checkParams(cmd Command, p Params) string {
+	for k, v := range p {
+		switch {
+		case c.cfg.DSN && isDSNParam(cmd, k):
+			// checked all together below.
+		case cmd == MAILFROM && k == "BODY":
+			// We advertise 8BITMIME, so this is fine.
+			v = strings.ToUpper(v)
+			if v == "BINARYMIME" && c.cfg.Chunking {
+				break
+			}
+			if v != "7BIT" && v != "8BITMIME" {
+				return "555 5.5.4 Unsupported BODY type"
+			}
+		case cmd == MAILFROM && k == "SIZE":
+			// RFC 1870: we must refuse messages that are
+			// declared to be too big right away.
+			// A size too large to parse is still a size.
+			n, err := strconv.ParseUint(v, 10, 63)
+			if err != nil && !errors.Is(err, strconv.ErrRange) {
+				return "501 5.5.4 Bad SIZE parameter"
+			}
+			if err != nil || int64(n) > c.cfg.Limits.MsgSize {
+				return "552 5.3.4 Message size exceeds fixed maximum message size"
+			}
+		case cmd == MAILFROM && k == "SMTPUTF8" && c.cfg.SMTPUTF8:
+			if v != "" {
+				return "501 5.5.4 SMTPUTF8 does not take a value"
+			}
+		case cmd == MAILFROM && k == "REQUIRETLS" && c.cfg.RequireTLS:
+			if v != "" {
+				return "501 5.5.4 REQUIRETLS does not take a value"
+			}
+			if !c.TLSOn {
+				return "530 5.7.10 REQUIRETLS requires TLS"
+			}
+		case cmd == MAILFROM && k == "AUTH" && c.cfg.Authenticator != nil:
+			// RFC 4954 section 5. The value is checked and
+			// possibly replaced by Next().
+			if v == "" {
+				return "501 5.5.4 Bad AUTH parameter"
+			}
+		case c.cfg.Limits.NoParams:
+			return "555 5.5.4 MAIL FROM/RCPT TO parameters not recognized or not implemented"
+		}
+	}
+	if c.cfg.DSN {
+		if _, err := parseDSN(cmd, p); err != nil {
+			return fmt.Sprintf("501 5.5.4 Bad DSN parameter: %v", err)
+		}
+	}
+	return ""
 }
 
-// mimeParam() returns true if the parameter argument of a MAIL FROM
-// is what we expect for a client exploiting our advertisement of
-// 8BITMIME.
-func mimeParam(l ParsedLine) bool {
-	return l.Cmd == MAILFROM &&
-		(l.Params == "BODY=7BIT" || l.Params == "BODY=8BITMIME")
+// banner sends our greeting banner.
+func (c *Conn) banner() {
+	var announce string
+	if c.cfg.Announce != "" {
+		announce = "\n" + c.cfg.Announce
+	}
+	if c.cfg.SayTime {
+		c.replyMulti(220, "", "%s %s %s%s",
+			c.cfg.LocalName, c.cfg.SftName,
+			time.Now().Format(time.RFC1123Z), announce)
+	} else {
+		c.replyMulti(220, "", "%s %s%s", c.cfg.LocalName,
+			c.cfg.SftName, announce)
+	}
 }
 
 // Next returns the next high-level event from the SMTP connection.
 //
 // Next() guarantees that the SMTP protocol ordering requirements are
-// followed and only returns HELO/EHLO, MAIL FROM, RCPT TO, and DATA
-// commands, and the actual message submitted. The caller must reset
-// all accumulated information about a message when it sees either
-// EHLO/HELO or MAIL FROM.
+// followed and only returns HELO/EHLO (or LHLO), MAIL FROM, RCPT TO,
+// and DATA commands, and the actual message submitted. The caller
+// must reset all accumulated information about a message when it
+// sees either EHLO/HELO/LHLO or MAIL FROM. A message sent with BDAT
+// instead of DATA is only seen as the GOTDATA event; there is no DATA
+// command event.
 //
 // For commands and GOTDATA, the caller may call Reject() or
 // Tempfail() to reject or tempfail the command. Calling Accept() is
@@ -664,48 +1679,131 @@ func mimeParam(l ParsedLine) bool {
 // null sender ('<>'). RCPT TO addresses cannot be; Next() will fail
 // those itself.
 //
+// TOOBIG is returned instead of GOTDATA for a message that was over
+// Limits.MsgSize. The Conn has already given it a '552 5.3.4' reply
+// (one per recipient, for LMTP) and ended the transaction, so the
+// client can go on to send other messages. To find the end of the
+// message, the Conn reads and discards up to Limits.MsgDiscard more
+// of it, within Limits.MsgInput; if that fails, the connection is
+// aborted instead. There is no TOOBIG event with StreamData, since
+// we only find out that a message is too big as it is read; a too
+// big message is a GOTDATA event like any other, its Data fails with
+// ErrMsgTooBig, and the Conn replies 552 to it when the caller
+// replies (or calls Next()).
+//
 // TLSERROR is returned if the client tried STARTTLS on a TLS-enabled
 // connection but the TLS setup failed for some reason (eg the client
 // only supports SSLv2). The caller can use this to, eg, decide not to
-// offer TLS to that client in the future.
+// offer TLS to that client in the future. With Config.ImplicitTLS,
+// TLSERROR is instead the first event if the initial handshake fails.
 func (c *Conn) Next() EventInfo {
+	return c.NextContext(context.Background())
+}
+
+// NextContext is Next() with a context. If ctx is cancelled or its
+// deadline passes, whatever network IO Next() is doing is
+// interrupted, the client is sent a '421 4.3.2' reply (unless it has
+// already QUIT), and NextContext returns an ABORT event whose Arg is
+// "cancelled: " plus ctx.Err(). This can be used to shut down a
+// server or to put an overall time limit on a session. A cancelled
+// Conn is aborted for good; every later Next() also returns ABORT.
+func (c *Conn) NextContext(ctx context.Context) EventInfo {
+	if ctx.Done() == nil {
+		return c.next()
+	}
+	if err := ctx.Err(); err != nil {
+		c.cancel(err)
+		return c.next()
+	}
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+			c.cancel(ctx.Err())
+		case <-stop:
+		}
+	}()
+	return c.next()
+}
+
+func (c *Conn) next() EventInfo {
 	var evt EventInfo
 
-	if !c.replied && c.curcmd != noCmd {
+	// An LMTP message may still need several replies, unless
+	// we are done with the connection.
+	for !c.replied && c.curcmd != noCmd && c.state != sAbort {
 		c.Accept()
 	}
+	if c.spool != nil {
+		c.spool.Close()
+		c.spool = nil
+	}
 	if c.state == sStartup {
-		var announce string
 		c.state = sInitial
+		c.started = time.Now()
+		// The PROXY header comes before anything else, including
+		// TLS, and changes who we think the client is.
+		if c.cfg.ProxyProtocol {
+			c.readProxy()
+		}
 		// log preceeds the banner in case the banner hits an error.
-		c.log("#", "remote %v at %s", c.conn.RemoteAddr(),
+		c.log(LogInfo, "remote %v at %s", c.RemoteAddr(),
 			time.Now().Format(TimeFmt))
-		if c.cfg.Announce != "" {
-			announce = "\n" + c.cfg.Announce
+		// With implicit TLS, even the banner goes over TLS.
+		if c.cfg.ImplicitTLS && c.state != sAbort {
+			if err := c.startTLS(); err != nil {
+				evt.What = TLSERROR
+				evt.Arg = fmt.Sprintf("%v", err)
+				return evt
+			}
 		}
-		if c.cfg.SayTime {
-			c.replyMulti(220, "%s %s %s%s",
-				c.cfg.LocalName, c.cfg.SftName,
-				time.Now().Format(time.RFC1123Z), announce)
-		} else {
-			c.replyMulti(220, "%s %s%s", c.cfg.LocalName,
-				c.cfg.SftName, announce)
+		// No banner after a bad PROXY header.
+		if c.state != sAbort {
+			c.banner()
 		}
 	}
 
 	// Read DATA chunk if called for.
+	if c.state == sData && c.cfg.StreamData {
+		c.data = c.newDataReader()
+		evt.What = GOTDATA
+		evt.Data = c.data
+		evt.SMTPUTF8 = c.smtputf8
+		evt.RequireTLS = c.requiretls
+		c.startPostData()
+		c.addReceived(&evt, false)
+		return evt
+	}
 	if c.state == sData {
-		data := c.readData()
-		if len(data) > 0 {
-			evt.What = GOTDATA
-			evt.Arg = data
-			c.replied = false
+		data, sp, err := c.readData()
+		if c.toobig {
+			c.startPostData()
+			c.replyTooBig()
+			evt.What = TOOBIG
+			return evt
+		}
+		c.spool = sp
+		if len(data) > 0 || sp != nil || err != nil {
 			// This is technically correct; only a *successful*
 			// DATA block ends the mail transaction according to
 			// the RFCs. An unsuccessful one must be RSET.
-			c.state = sPostData
-			c.nstate = sHelo
-			return evt
+			c.startPostData()
+			if err != nil {
+				c.spoolFailed(err)
+			} else if !c.rejectBare() {
+				evt.What = GOTDATA
+				if sp != nil {
+					evt.Data = sp
+				} else {
+					evt.Arg = data
+				}
+				evt.SMTPUTF8 = c.smtputf8
+				evt.RequireTLS = c.requiretls
+				evt.BareEOL = c.BareEOLSeen && c.cfg.BareEOL == BareFlag
+				c.addReceived(&evt, false)
+				return evt
+			}
 		}
 		// If the data read failed, c.state will be sAbort and we
 		// will exit in the main loop.
@@ -719,15 +1817,72 @@ func (c *Conn) Next() EventInfo {
 
 		line := c.readCmd()
 		if line == "" {
+			// This does nothing if readCmd() aborted.
+			c.abort(AbortBadCmds, errors.New("empty command line"), 0)
+			break
+		}
+		c.cmds++
+		if c.overLimit(c.cmds, c.cfg.Limits.Cmds, "too many commands") {
 			break
 		}
 
-		res := ParseCmd(line)
+		var res ParsedLine
+		if c.cfg.SMTPUTF8 {
+			res = ParseCmdUTF8(line)
+		} else {
+			res = ParseCmd(line)
+		}
+		c.logCmd(line, res.Cmd)
+		if c.badBareCmd(line) {
+			c.badcmds++
+			c.reply("501 5.5.2 Bad: bare CR or LF in command")
+			continue
+		}
 		if res.Cmd == BadCmd {
 			c.badcmds++
-			c.reply("501 Bad: %s", res.Err)
+			c.reply("501 5.5.2 Bad: %s", res.Err)
+			continue
+		}
+		// BDAT must consume its chunk no matter what, so it
+		// handles its own sequencing. A good LAST chunk is
+		// handled just like the message from DATA, including
+		// setting c.curcmd to DATA.
+		if res.Cmd == BDAT && c.cfg.Chunking && res.Err == "" {
+			if !c.readChunk(res.Arg) {
+				continue
+			}
+			c.curcmd = DATA
+			c.startPostData()
+			sp, err := c.chunks.spool()
+			if err != nil {
+				c.spoolFailed(err)
+				continue
+			}
+			evt.What = GOTDATA
+			switch {
+			case sp != nil:
+				c.spool = sp
+				evt.Data = sp
+			case c.cfg.StreamData:
+				// c.chunks is only reset by the next
+				// transaction's first BDAT.
+				evt.Data = strings.NewReader(c.chunks.String())
+			default:
+				evt.Arg = c.chunks.String()
+				c.chunks.discard()
+			}
+			evt.SMTPUTF8 = c.smtputf8
+			evt.RequireTLS = c.requiretls
+			c.addReceived(&evt, true)
+			return evt
+		}
+
+		// LMTP uses LHLO instead of HELO and EHLO.
+		if (res.Cmd == LHLO) != c.cfg.LMTP && (res.Cmd == LHLO || res.Cmd == HELO || res.Cmd == EHLO) {
+			c.reply("502 5.5.1 Not supported")
 			continue
 		}
+
 		// Is this command valid in this state at all?
 		// Since we implicitly support PIPELINING, which can
 		// result in out of sequence commands when earlier ones
@@ -735,12 +1890,12 @@ func (c *Conn) Next() EventInfo {
 		// commands.
 		t := states[res.Cmd]
 		if t.validin != 0 && (t.validin&c.state) == 0 {
-			c.reply("503 Out of sequence command")
+			c.reply("503 5.5.1 Out of sequence command")
 			continue
 		}
 		// Error in command?
 		if len(res.Err) > 0 {
-			c.reply("553 Garbled command: %s", res.Err)
+			c.reply("553 5.5.2 Garbled command: %s", res.Err)
 			continue
 		}
 
@@ -750,62 +1905,61 @@ func (c *Conn) Next() EventInfo {
 		if t.validin == 0 {
 			switch res.Cmd {
 			case NOOP:
-				c.reply("250 Okay")
+				c.noops++
+				if c.overLimit(c.noops, c.cfg.Limits.Noops, "too many NOOPs") {
+					continue
+				}
+				c.reply("250 2.0.0 Okay")
 			case RSET:
+				c.rsets++
+				if c.overLimit(c.rsets, c.cfg.Limits.Rsets, "too many RSETs") {
+					continue
+				}
 				// It's valid to RSET before EHLO and
 				// doing so can't skip EHLO.
 				if c.state != sInitial {
 					c.state = sHelo
 				}
-				c.reply("250 Okay")
+				c.xforwardDone()
+				c.reply("250 2.0.0 Okay")
 				// RSETs are not delivered to higher levels;
 				// they are implicit in sudden MAIL FROMs.
 			case QUIT:
 				c.state = sQuit
-				c.reply("221 Goodbye")
+				c.reply("221 2.0.0 Goodbye")
 				// Will exit at main loop.
 			case HELP:
-				c.reply("214 No help here")
+				c.reply("214 2.0.0 No help here")
+			case AUTH:
+				c.authenticate(res.Arg)
+			case VRFY, EXPN:
+				c.verify(res.Cmd, res.Arg)
+			case XCLIENT:
+				c.xclient(res.Arg)
+			case XFORWARD:
+				c.xforward(res.Arg)
 			case STARTTLS:
 				if c.cfg.TLSConfig == nil || c.TLSOn {
-					c.reply("502 Not supported")
+					c.reply("502 5.5.1 Not supported")
 					continue
 				}
-				c.reply("220 Ready to start TLS")
+				c.reply("220 2.0.0 Ready to start TLS")
 				if c.state == sAbort {
 					continue
 				}
-				// Since we're about to start chattering on
-				// conn outside of our normal framework, we
-				// must reset both read and write timeouts
-				// to our TLS setup timeout.
-				c.conn.SetDeadline(time.Now().Add(c.cfg.Limits.TLSSetup))
-				tlsConn := tls.Server(c.conn, c.cfg.TLSConfig)
-				err := tlsConn.Handshake()
-				if err != nil {
-					c.log("!", "TLS setup failed: %v", err)
-					c.state = sAbort
+				if err := c.startTLS(); err != nil {
 					evt.What = TLSERROR
 					evt.Arg = fmt.Sprintf("%v", err)
 					return evt
 				}
-				// With TLS set up, we now want no read and
-				// write deadlines on the underlying
-				// connection. So cancel all deadlines by
-				// providing a zero value.
-				c.conn.SetReadDeadline(time.Time{})
-				// switch c.conn to tlsConn.
-				c.setupConn(tlsConn)
-				c.TLSOn = true
-				cs := tlsConn.ConnectionState()
-				c.log("!", "TLS negociated with cipher 0x%04x", cs.CipherSuite)
-				c.TLSCipher = cs.CipherSuite
 				// By the STARTTLS RFC, we return to our state
 				// immediately after the greeting banner
-				// and clients must re-EHLO.
+				// and clients must re-EHLO. This includes
+				// forgetting any AUTH.
 				c.state = sInitial
+				c.AuthUser = ""
 			default:
-				c.reply("502 Not supported")
+				c.reply("502 5.5.1 Not supported")
 			}
 			continue
 		}
@@ -814,6 +1968,7 @@ func (c *Conn) Next() EventInfo {
 		c.nstate = t.next
 		c.replied = false
 		c.curcmd = res.Cmd
+		c.curarg = res.Arg
 
 		// RCPT TO:<> is invalid; reject it. Otherwise defer all
 		// address checking to our callers.
@@ -821,12 +1976,59 @@ func (c *Conn) Next() EventInfo {
 			c.Reject()
 			continue
 		}
-		// reject parameters that we don't accept, which right
-		// now is all of them. We reject with the RFC-correct
-		// reply instead of a generic one, so we can't use
-		// c.Reject().
-		if res.Params != "" && c.cfg.Limits.NoParams && !mimeParam(res) {
-			c.reply("504 Command parameter not implemented")
+		// RFC 5321 section 4.5.3.1.10.
+		if res.Cmd == RCPTTO && c.cfg.Limits.Rcpts > 0 && c.nrcpts >= c.cfg.Limits.Rcpts {
+			c.reply("452 4.5.3 Too many recipients")
+			c.replied = true
+			continue
+		}
+		if res.Cmd == MAILFROM && c.overLimit(c.nmsgs+1, c.cfg.Limits.Msgs, "too many messages") {
+			break
+		}
+		// RFC 3030: BINARYMIME messages can only be sent with
+		// BDAT.
+		if res.Cmd == DATA && c.binarymime {
+			c.reply("503 5.5.1 BINARYMIME requires BDAT")
+			c.replied = true
+			continue
+		}
+		// Parse parameters and reject ones that are malformed
+		// or that we don't accept. We reject with the
+		// RFC-correct replies instead of a generic one, so we
+		// can't use c.Reject().
+		params, err := ParseParams(res.Params)
+		if err != nil {
+			c.reply("501 5.5.4 Bad parameters: %v", err)
+			c.replied = true
+			continue
+		}
+		if msg := c.checkParams(res.Cmd, params); msg != "" {
+			c.reply("%s", msg)
+			c.replied = true
+			continue
+		}
+		// RFC 4954: we only pass on an AUTH= identity from a
+		// client that has authenticated; otherwise it is
+		// treated as AUTH=<>.
+		if params.Has("AUTH") && c.AuthUser == "" {
+			params["AUTH"] = "<>"
+		}
+		if res.Cmd == MAILFROM {
+			// XFORWARD attributes are only good for one
+			// transaction.
+			if c.xfwdDone {
+				c.XForward = nil
+				c.xfwdDone = false
+			}
+			c.nrcpts = 0
+			c.binarymime = strings.ToUpper(params["BODY"]) == "BINARYMIME"
+			c.smtputf8 = params.Has("SMTPUTF8")
+			c.requiretls = params.Has("REQUIRETLS")
+		}
+		// RFC 6531: UTF-8 addresses are only allowed in SMTPUTF8
+		// transactions.
+		if !isall7bit([]byte(res.Arg)) && !c.smtputf8 {
+			c.reply("553 5.6.7 Non-ASCII address requires SMTPUTF8")
 			c.replied = true
 			continue
 		}
@@ -837,6 +2039,15 @@ func (c *Conn) Next() EventInfo {
 		evt.Cmd = res.Cmd
 		// TODO: does this hold down more memory than necessary?
 		evt.Arg = res.Arg
+		evt.Params = params
+		evt.Addr = res.Addr
+		evt.SMTPUTF8 = c.smtputf8 && res.Cmd != HELO && res.Cmd != EHLO && res.Cmd != LHLO
+		evt.RequireTLS = c.requiretls && res.Cmd != HELO && res.Cmd != EHLO && res.Cmd != LHLO
+		evt.BareEOL = c.BareEOLSeen && c.cfg.BareEOL == BareFlag
+		if c.cfg.DSN {
+			// Already checked by checkParams().
+			evt.DSN, _ = parseDSN(res.Cmd, params)
+		}
 		return evt
 	}
 
@@ -845,24 +2056,40 @@ func (c *Conn) Next() EventInfo {
 	// see it if they send anything more. It will also go in the
 	// SMTP command log.
 	evt.Arg = ""
-	if c.badcmds > c.cfg.Limits.BadCmds {
-		c.reply("554 Too many bad commands")
-		c.state = sAbort
+	cerr := c.uncancel()
+	switch {
+	case cerr != nil && c.state != sQuit:
+		// Whatever we were doing was interrupted, so all we
+		// can do is tell the client that we're going away.
+		c.shutdownReply(fmt.Errorf("cancelled: %w", cerr))
+		evt.Arg = fmt.Sprintf("cancelled: %v", cerr)
+	case c.badcmds > c.cfg.Limits.BadCmds:
+		c.reply("554 5.5.0 Too many bad commands")
+		c.abort(AbortBadCmds, nil, 0)
 		evt.Arg = "too many bad commands"
+	case c.aborted != nil && c.aborted.Reason == AbortLimit:
+		evt.Arg = c.aborted.Err.Error()
 	}
+	// Throw away any BDAT message we still have.
+	c.chunks.discard()
 	if c.state == sQuit {
 		evt.What = DONE
-		c.log("#", "finished at %v", time.Now().Format(TimeFmt))
+		c.log(LogInfo, "finished at %v", time.Now().Format(TimeFmt))
 	} else {
 		evt.What = ABORT
-		c.log("#", "abort at %v", time.Now().Format(TimeFmt))
+		if c.aborted != nil {
+			evt.Err = c.aborted
+		}
+		c.logAbort(evt.Err)
 	}
 	return evt
 }
 
 // We need this for re-setting up the connection on TLS start.
 func (c *Conn) setupConn(conn net.Conn) {
+	c.smu.Lock()
 	c.conn = conn
+	c.smu.Unlock()
 	// io.LimitReader() returns a Reader, not a LimitedReader, and
 	// we want access to the public lr.N field so we can manipulate
 	// it.
@@ -881,10 +2108,14 @@ func (c *Conn) setupConn(conn net.Conn) {
 // written to the network (server replies), '!'  means an error, and
 // '#' is tracking information for the start or the end of the
 // connection. Further information is up to whatever is behind 'log'
-// to add.
+// to add. The same things are given as LogEvents, with more details,
+// to Config.Logger if it is set.
 func NewConn(conn net.Conn, cfg Config, log io.Writer) *Conn {
-	c := &Conn{state: sStartup, cfg: cfg, logger: log}
+	c := &Conn{ID: nextConnID(), state: sStartup, cfg: cfg, logger: log}
 	c.setupConn(conn)
+	if pc, ok := conn.(*ProxyConn); ok {
+		c.Proxy = pc.Header
+	}
 	if c.cfg.Limits == nil {
 		c.cfg.Limits = &DefaultLimits
 	}
@@ -6,10 +6,21 @@ package smtpd
 import (
 	"bufio"
 	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"fmt"
 	"io"
+	"math/big"
 	"net"
 	"strings"
 	"testing"
+	"testing/iotest"
 	"time"
 )
 
@@ -59,6 +70,10 @@ var smtpValidTests = []struct {
 
 	// Space after MAIL FROM:
 	{"MAIL FROM: <fred@barney>", MAILFROM, "fred@barney"},
+
+	// Things that need real address parsing.
+	{`MAIL FROM:<"fred>"@barney> SIZE=100`, MAILFROM, `"fred>"@barney`},
+	{"RCPT TO:<@a.org,@b.org:fred@[192.0.2.1]>", RCPTTO, "@a.org,@b.org:fred@[192.0.2.1]"},
 }
 
 func TestGoodParses(t *testing.T) {
@@ -176,26 +191,15 @@ func (f faker) RemoteAddr() net.Addr {
 // returns expected server output \r\n'd, and the actual output.
 // current approach cribbed from the net/smtp tests.
 func runSmtpTest(serverStr, clientStr string) (string, string) {
+	return runSmtpTestCfg(Config{}, serverStr, clientStr)
+}
+
+// runSmtpTestCfg is runSmtpTest with a specific Config.
+func runSmtpTestCfg(cfg Config, serverStr, clientStr string) (string, string) {
 	server := strings.Join(strings.Split(serverStr, "\n"), "\r\n")
 	client := strings.Join(strings.Split(clientStr, "\n"), "\r\n")
-
-	var outbuf bytes.Buffer
-	writer := bufio.NewWriter(&outbuf)
-	reader := bufio.NewReader(strings.NewReader(client))
-	cxn := &faker{ReadWriter: bufio.NewReadWriter(reader, writer)}
-
-	// Server(reader, writer)
-	var evt EventInfo
-	conn := NewConn(cxn, Config{}, nil)
-	for {
-		evt = conn.Next()
-		if evt.What == DONE || evt.What == ABORT {
-			break
-		}
-	}
-
-	writer.Flush()
-	return server, outbuf.String()
+	_, _, out := runConn(cfg, strings.NewReader(client), nil, nil)
+	return server, out
 }
 func TestBasicSmtpd(t *testing.T) {
 	server, actualout := runSmtpTest(basicServer, basicClient)
@@ -229,18 +233,20 @@ var basicServer = `220 localhost go-smtpd
 250-localhost Hello 127.10.10.100:56789
 250-8BITMIME
 250-PIPELINING
+250-ENHANCEDSTATUSCODES
+250-SIZE 5242880
 250 HELP
-250 Okay, I'll believe you for now
-250 Okay, I'll believe you for now
+250 2.1.0 Okay, I'll believe you for now
+250 2.1.5 Okay, I'll believe you for now
 354 Send away
-250 I've put it in a can
-250 Okay, I'll believe you for now
-250 Okay, I'll believe you for now
+250 2.0.0 I've put it in a can
+250 2.1.0 Okay, I'll believe you for now
+250 2.1.5 Okay, I'll believe you for now
 354 Send away
-250 I've put it in a can
-503 Out of sequence command
+250 2.0.0 I've put it in a can
+503 5.5.1 Out of sequence command
 250 localhost Hello 127.10.10.100:56789
-221 Goodbye
+221 2.0.0 Goodbye
 `
 
 func TestSequenceErrors(t *testing.T) {
@@ -269,23 +275,25 @@ RCPT TO:<abc@def>
 RCPT TO:<abc@ghi> SIZE=9999
 `
 var sequenceServer = `220 localhost go-smtpd
-503 Out of sequence command
-250 Okay
-503 Out of sequence command
+503 5.5.1 Out of sequence command
+250 2.0.0 Okay
+503 5.5.1 Out of sequence command
 250-localhost Hello 127.10.10.100:56789
 250-8BITMIME
 250-PIPELINING
+250-ENHANCEDSTATUSCODES
+250-SIZE 5242880
 250 HELP
-250 Okay
-503 Out of sequence command
-250 Okay, I'll believe you for now
-503 Out of sequence command
-501 Bad: unrecognized command
-250 Okay
-250 Okay, I'll believe you for now
-550 Bad address
-250 Okay, I'll believe you for now
-504 Command parameter not implemented
+250 2.0.0 Okay
+503 5.5.1 Out of sequence command
+250 2.1.0 Okay, I'll believe you for now
+503 5.5.1 Out of sequence command
+501 5.5.2 Bad: unrecognized command
+250 2.0.0 Okay
+250 2.1.0 Okay, I'll believe you for now
+550 5.1.0 Bad address
+250 2.1.5 Okay, I'll believe you for now
+555 5.5.4 MAIL FROM/RCPT TO parameters not recognized or not implemented
 `
 
 // Test the stream of events emitted from Next(), as opposed to the output
@@ -321,25 +329,709 @@ QUIT
 func TestSequence(t *testing.T) {
 	client := strings.Join(strings.Split(testClient, "\n"), "\r\n")
 
-	var outbuf bytes.Buffer
-	writer := bufio.NewWriter(&outbuf)
-	reader := bufio.NewReader(strings.NewReader(client))
-	cxn := &faker{ReadWriter: bufio.NewReadWriter(reader, writer)}
-
-	// Server(reader, writer)
-	var evt EventInfo
-	conn := NewConn(cxn, Config{}, nil)
 	pos := 0
-	for {
-		evt = conn.Next()
+	runConn(Config{}, strings.NewReader(client), nil, func(c *Conn, evt EventInfo) {
 		ts := testStream[pos]
 		if evt.What != ts.what || evt.Cmd != ts.cmd {
 			t.Fatalf("Sequence mismatch at step %d: expected %v %v got %v %v\n",
 				pos, ts.what, ts.cmd, evt.What, evt.Cmd)
 		}
 		pos++
-		if evt.What == DONE {
+	})
+}
+
+// Test RFC 1870 SIZE handling, both the SIZE= parameter on MAIL FROM
+// and the size limit on the DATA. The first message is exactly at
+// the limit once dot-stuffing is removed (5 lines of '.' + CR NL,
+// which is 15 bytes); the second is one byte over and so aborts the
+// connection.
+func TestSizeLimits(t *testing.T) {
+	lim := DefaultLimits
+	lim.MsgSize = 15
+	server, actualout := runSmtpTestCfg(Config{Limits: &lim}, sizeServer, sizeClient)
+	if actualout != server {
+		t.Fatalf("Got:\n%s\nExpected:\n%s", actualout, server)
+	}
+}
+
+var sizeClient = `EHLO localhost
+MAIL FROM:<a@b.com> SIZE=16
+MAIL FROM:<a@b.com> SIZE=99999999999999999999
+MAIL FROM:<a@b.com> SIZE=-1
+MAIL FROM:<a@b.com> SIZE=15
+RCPT TO:<c@d.org>
+DATA
+..
+..
+..
+..
+..
+.
+MAIL FROM:<a@b.com>
+RCPT TO:<c@d.org>
+DATA
+..
+..
+..
+..
+...
+.
+QUIT
+`
+var sizeServer = `220 localhost go-smtpd
+250-localhost Hello 127.10.10.100:56789
+250-8BITMIME
+250-PIPELINING
+250-ENHANCEDSTATUSCODES
+250-SIZE 15
+250 HELP
+552 5.3.4 Message size exceeds fixed maximum message size
+552 5.3.4 Message size exceeds fixed maximum message size
+501 5.5.4 Bad SIZE parameter
+250 2.1.0 Okay, I'll believe you for now
+250 2.1.5 Okay, I'll believe you for now
+354 Send away
+250 2.0.0 I've put it in a can
+250 2.1.0 Okay, I'll believe you for now
+250 2.1.5 Okay, I'll believe you for now
+354 Send away
+552 5.3.4 Message too big
+221 2.0.0 Goodbye
+`
+
+// A message that is too big gets a 552 and a TOOBIG event, and the
+// session goes on. One that is too big even to discard aborts.
+func TestTooBig(t *testing.T) {
+	lim := DefaultLimits
+	lim.MsgSize = 10
+	lim.MsgDiscard = 100
+	msg := "MAIL FROM:<a@b.com>\nRCPT TO:<c@d.org>\nRCPT TO:<e@d.org>\nDATA\n"
+	client := "LHLO localhost\n" + msg + "This is too big\n.\n" + msg + "Small\n.\n" + msg + strings.Repeat("This is much too big\n", 400) + ".\nQUIT\n"
+	client = strings.Join(strings.Split(client, "\n"), "\r\n")
+
+	for _, stream := range []bool{false, true} {
+		// The client is read a byte at a time so that read-ahead
+		// doesn't use up any of the discard limit.
+		_, evts, out := runConn(Config{Limits: &lim, LMTP: true, StreamData: stream}, iotest.OneByteReader(strings.NewReader(client)), nil, nil)
+		var got []Event
+		for _, e := range evts {
+			if e.What != COMMAND {
+				got = append(got, e.What)
+			}
+		}
+		// Streamed messages aren't known to be too big until
+		// they're read, so they never get a TOOBIG event.
+		want := []Event{TOOBIG, GOTDATA, ABORT}
+		if stream {
+			want = []Event{GOTDATA, GOTDATA, GOTDATA, ABORT}
+		}
+		if fmt.Sprint(got) != fmt.Sprint(want) {
+			t.Fatalf("stream %v: wrong events %v\n%s", stream, got, out)
+		}
+		if !strings.Contains(out, "354 Send away\r\n552 5.3.4 Message too big\r\n552 5.3.4 Message too big\r\n250 2.1.0 ") {
+			t.Fatalf("stream %v: too big message not rejected\n%s", stream, out)
+		}
+		var ae *AbortError
+		if !errors.As(evts[len(evts)-1].Err, &ae) || ae.Reason != AbortMsgTooBig {
+			t.Fatalf("stream %v: wrong abort: %v", stream, evts[len(evts)-1].Err)
+		}
+	}
+}
+
+// Per-session limits end the session with a 421 and say why, except
+// for the recipient limit, which just refuses extra recipients.
+func TestSessionLimits(t *testing.T) {
+	msg := "MAIL FROM:<a@b.com>\nRCPT TO:<c@d.org>\nDATA\nHi.\n.\n"
+	cases := []struct {
+		set    func(*Limits)
+		client string
+		why    string
+	}{
+		{func(l *Limits) { l.Msgs = 1 }, "HELO localhost\n" + msg + msg, "too many messages"},
+		{func(l *Limits) { l.Cmds = 3 }, "HELO localhost\nNOOP\nNOOP\nNOOP\n", "too many commands"},
+		{func(l *Limits) { l.Noops = 1 }, "HELO localhost\nNOOP\nNOOP\n", "too many NOOPs"},
+		{func(l *Limits) { l.Rsets = 1 }, "HELO localhost\nRSET\nRSET\n", "too many RSETs"},
+		{func(l *Limits) { l.Lifetime = time.Nanosecond }, "HELO localhost\n", "session too long"},
+	}
+	for _, c := range cases {
+		lim := DefaultLimits
+		c.set(&lim)
+		evts, out := runSmtpEvents(Config{Limits: &lim}, c.client+"QUIT\n")
+		last := evts[len(evts)-1]
+		if last.What != ABORT || last.Arg != c.why || !strings.HasSuffix(out, "\r\n421 4.7.0 localhost Session limit exceeded: "+c.why+"\r\n") {
+			t.Fatalf("limit '%s' not enforced: %+v\n%s", c.why, last, out)
+		}
+	}
+
+	lim := DefaultLimits
+	lim.Rcpts = 2
+	evts, out := runSmtpEvents(Config{Limits: &lim}, "HELO localhost\nMAIL FROM:<a@b.com>\nRCPT TO:<c@d.org>\nRCPT TO:<e@d.org>\nRCPT TO:<f@d.org>\nDATA\nHi.\n.\nQUIT\n")
+	if !strings.Contains(out, "\r\n452 4.5.3 Too many recipients\r\n354 ") || evts[len(evts)-1].What != DONE {
+		t.Fatalf("recipient limit not enforced:\n%s", out)
+	}
+}
+
+// runConn runs client, which must have its own line endings, against
+// a Conn with cfg and the text log log. It calls fn, if it is not nil,
+// with every event that Next() generates, including the final DONE or
+// ABORT; whatever fn doesn't reply to is accepted. It returns the
+// Conn, all of the events, and the server output.
+func runConn(cfg Config, client io.Reader, log io.Writer, fn func(*Conn, EventInfo)) (*Conn, []EventInfo, string) {
+	var outbuf bytes.Buffer
+	var evts []EventInfo
+	writer := bufio.NewWriter(&outbuf)
+	reader := bufio.NewReader(client)
+	cxn := &faker{ReadWriter: bufio.NewReadWriter(reader, writer)}
+
+	conn := NewConn(cxn, cfg, log)
+	for {
+		evt := conn.Next()
+		evts = append(evts, evt)
+		if fn != nil {
+			fn(conn, evt)
+		}
+		if evt.What == DONE || evt.What == ABORT {
+			break
+		}
+	}
+	writer.Flush()
+	return conn, evts, outbuf.String()
+}
+
+// runPipe runs a Conn with cfg on one end of a net.Pipe(), which
+// unlike faker honours deadlines, accepting everything. It writes
+// each of writes to the other end separately and returns the events
+// and the server output.
+func runPipe(cfg Config, writes ...string) ([]EventInfo, string) {
+	sc, cc := net.Pipe()
+	defer cc.Close()
+	go func() {
+		for _, w := range writes {
+			if _, err := cc.Write([]byte(w)); err != nil {
+				return
+			}
+		}
+	}()
+	out := make(chan []byte)
+	go func() {
+		b, _ := io.ReadAll(cc)
+		out <- b
+	}()
+	var evts []EventInfo
+	conn := NewConn(sc, cfg, nil)
+	for {
+		evt := conn.Next()
+		evts = append(evts, evt)
+		if evt.What == DONE || evt.What == ABORT {
 			break
 		}
 	}
+	sc.Close()
+	return evts, string(<-out)
+}
+
+// runSmtpEvents runs clientStr against a Conn with the given config
+// and returns all of the events that Next() generated, accepting
+// everything, and the server output.
+func runSmtpEvents(cfg Config, clientStr string) ([]EventInfo, string) {
+	client := strings.Join(strings.Split(clientStr, "\n"), "\r\n")
+	_, evts, out := runConn(cfg, strings.NewReader(client), nil, nil)
+	return evts, out
+}
+
+// Test BDAT, both good transactions and various failures.
+func TestChunking(t *testing.T) {
+	lim := DefaultLimits
+	lim.MsgSize = 20
+	cfg := Config{Limits: &lim, Chunking: true}
+	evts, actualout := runSmtpEvents(cfg, chunkClient)
+	server := strings.Join(strings.Split(chunkServer, "\n"), "\r\n")
+	if actualout != server {
+		t.Fatalf("Got:\n%s\nExpected:\n%s", actualout, server)
+	}
+	var data []string
+	for _, e := range evts {
+		if e.What == GOTDATA {
+			data = append(data, e.Arg)
+		}
+	}
+	if len(data) != 1 || data[0] != "Hello\r\nThere.\r\n" {
+		t.Fatalf("wrong message data: %q", data)
+	}
+}
+
+// A BDAT chunk that we reject is still read, however late in the
+// session it comes, but only up to MsgDiscard of it.
+func TestChunkDiscard(t *testing.T) {
+	cfg := Config{Chunking: true}
+	evts, out := runPipe(cfg, "HELO localhost\r\nMAIL FROM:<a@b.com>\r\nRCPT TO:<>\r\nBDAT 5 LAST\r\n", "hello", "QUIT\r\n")
+	if evts[len(evts)-1].What != DONE || !strings.HasSuffix(out, "\r\n503 5.5.1 Out of sequence command\r\n221 2.0.0 Goodbye\r\n") {
+		t.Fatalf("rejected chunk not read:\n%s", out)
+	}
+
+	lim := DefaultLimits
+	lim.MsgDiscard = 10
+	evts, out = runSmtpEvents(Config{Limits: &lim, Chunking: true}, "HELO localhost\nBDAT 11 LAST\n01234567890QUIT\n")
+	var ae *AbortError
+	if last := evts[len(evts)-1]; last.What != ABORT || !errors.As(last.Err, &ae) || ae.Reason != AbortMsgTooBig {
+		t.Fatalf("too big chunk was discarded: %+v\n%s", last, out)
+	}
+}
+
+var chunkClient = `EHLO localhost
+BDAT 4
+ab
+MAIL FROM:<a@b.com> BODY=BINARYMIME
+RCPT TO:<c@d.org>
+DATA
+BDAT 7
+Hello
+BDAT 8 LAST
+There.
+MAIL FROM:<a@b.com>
+RCPT TO:<c@d.org>
+BDAT 30 LAST
+0123456789012345678901234567
+MAIL FROM:<a@b.com>
+QUIT
+`
+var chunkServer = `220 localhost go-smtpd
+250-localhost Hello 127.10.10.100:56789
+250-8BITMIME
+250-PIPELINING
+250-ENHANCEDSTATUSCODES
+250-SIZE 20
+250-CHUNKING
+250-BINARYMIME
+250 HELP
+503 5.5.1 Out of sequence command
+250 2.1.0 Okay, I'll believe you for now
+250 2.1.5 Okay, I'll believe you for now
+503 5.5.1 BINARYMIME requires BDAT
+250 2.0.0 7 octets received
+250 2.0.0 I've put it in a can
+250 2.1.0 Okay, I'll believe you for now
+250 2.1.5 Okay, I'll believe you for now
+552 5.3.4 Message size exceeds fixed maximum message size
+250 2.1.0 Okay, I'll believe you for now
+221 2.0.0 Goodbye
+`
+
+// UTF-8 is only accepted by ParseCmdUTF8, and then only in MAIL FROM
+// and RCPT TO addresses.
+func TestUTF8Parses(t *testing.T) {
+	s := ParseCmdUTF8("MAIL FROM:<Å@fred.com> SMTPUTF8")
+	if s.Cmd != MAILFROM || s.Err != "" || s.Arg != "Å@fred.com" || s.Params != "SMTPUTF8" {
+		t.Fatalf("bad parse of UTF-8 MAIL FROM: %+v", s)
+	}
+	s = ParseCmdUTF8("rcpt to:<θ@δ.example>")
+	if s.Cmd != RCPTTO || s.Err != "" || s.Arg != "θ@δ.example" {
+		t.Fatalf("bad parse of UTF-8 RCPT TO: %+v", s)
+	}
+	for _, l := range []string{"HELO Å", "MAIL FROM:<a@b> X=Å", "MAIL FROM:<\xff@b>", "rſet"} {
+		s = ParseCmdUTF8(l)
+		if s.Cmd != BadCmd || s.Err == "" {
+			t.Fatalf("'%s' not detected as error: %+v", l, s)
+		}
+	}
 }
+
+func TestSMTPUTF8(t *testing.T) {
+	evts, actualout := runSmtpEvents(Config{SMTPUTF8: true}, utf8Client)
+	server := strings.Join(strings.Split(utf8Server, "\n"), "\r\n")
+	if actualout != server {
+		t.Fatalf("Got:\n%s\nExpected:\n%s", actualout, server)
+	}
+	for _, e := range evts {
+		want := e.What == GOTDATA || e.Cmd == RCPTTO || e.Cmd == DATA || (e.Cmd == MAILFROM && e.Params.Has("SMTPUTF8"))
+		if e.SMTPUTF8 != want {
+			t.Fatalf("wrong SMTPUTF8 flag on event %+v", e)
+		}
+	}
+}
+
+var utf8Client = `EHLO localhost
+MAIL FROM:<Å@fred.com>
+MAIL FROM:<fred@fred.com>
+RCPT TO:<θ@δ.example>
+RSET
+MAIL FROM:<Å@fred.com> SMTPUTF8
+RCPT TO:<θ@δ.example>
+DATA
+Subject: ünïcödé
+
+.
+QUIT
+`
+var utf8Server = `220 localhost go-smtpd
+250-localhost Hello 127.10.10.100:56789
+250-8BITMIME
+250-PIPELINING
+250-ENHANCEDSTATUSCODES
+250-SIZE 5242880
+250-SMTPUTF8
+250 HELP
+553 5.6.7 Non-ASCII address requires SMTPUTF8
+250 2.1.0 Okay, I'll believe you for now
+553 5.6.7 Non-ASCII address requires SMTPUTF8
+250 2.0.0 Okay
+250 2.1.0 Okay, I'll believe you for now
+250 2.1.5 Okay, I'll believe you for now
+354 Send away
+250 2.0.0 I've put it in a can
+221 2.0.0 Goodbye
+`
+
+// Caller supplied enhanced status codes are used if they are valid for
+// the reply and go on every line of a multi-line reply.
+func TestEnhancedMsgs(t *testing.T) {
+	client := "EHLO localhost\r\nMAIL FROM:<a@b.com>\r\nRCPT TO:<c@d.com>\r\nRCPT TO:<e@d.com>\r\nQUIT\r\n"
+	_, _, out := runConn(Config{}, strings.NewReader(client), nil, func(conn *Conn, evt EventInfo) {
+		switch {
+		case evt.Cmd == MAILFROM:
+			conn.AcceptMsgEnhanced("4.1.0", "Sender ok")
+		case evt.Cmd == RCPTTO && evt.Arg == "c@d.com":
+			conn.RejectMsgEnhanced("5.1.1", "No such user\nReally")
+		case evt.Cmd == RCPTTO:
+			conn.TempfailMsgEnhanced("4.2.2", "Mailbox full")
+		}
+	})
+	for _, l := range []string{"250 2.1.0 Sender ok\r\n", "550-5.1.1 No such user\r\n550 5.1.1 Really\r\n", "450 4.2.2 Mailbox full\r\n"} {
+		if !strings.Contains(out, l) {
+			t.Fatalf("missing '%s' in output:\n%s", l, out)
+		}
+	}
+}
+
+// Reply gives arbitrary valid replies and moves the state machine
+// on for 2xx ones.
+func TestReply(t *testing.T) {
+	client := "EHLO localhost\r\nMAIL FROM:<a@b.com>\r\nRCPT TO:<c@d.com>\r\nRCPT TO:<e@d.com>\r\nDATA\r\nHi.\r\n.\r\nRSET\r\nHELO localhost\r\nQUIT\r\n"
+	if NewConn(&faker{}, Config{}, nil).Reply(250, "", "Too early") == nil {
+		t.Fatalf("Reply worked before any command")
+	}
+	_, evts, out := runConn(Config{}, strings.NewReader(client), nil, func(conn *Conn, evt EventInfo) {
+		if evt.What == DONE || evt.What == ABORT {
+			return
+		}
+		var err, bad error
+		switch {
+		case evt.Cmd == EHLO:
+			// EHLO must be accepted with Accept().
+			bad = conn.Reply(250, "", "Hi")
+			conn.Accept()
+		case evt.Cmd == MAILFROM:
+			if conn.Reply(251, "", "Not for MAIL FROM") == nil {
+				t.Fatalf("251 reply to MAIL FROM accepted")
+			}
+			bad = conn.Reply(250, "5.1.0", "Wrong class")
+			err = conn.Reply(250, "2.1.0", "Sender ok")
+		case evt.Cmd == RCPTTO && evt.Arg == "c@d.com":
+			err = conn.Reply(251, "2.1.5", "User not local; will forward to <c@e.com>")
+		case evt.Cmd == RCPTTO:
+			err = conn.Reply(452, "4.5.3", "Too many recipients")
+		case evt.Cmd == DATA:
+			bad = conn.Reply(250, "", "Not for DATA")
+			err = conn.Reply(354, "2.0.0", "Go ahead")
+		case evt.What == GOTDATA:
+			err = conn.Reply(552, "5.3.4", "Message too big for system")
+		case evt.Cmd == HELO:
+			err = conn.Reply(421, "", "Going away")
+		}
+		if err != nil {
+			t.Fatalf("Reply failed for %+v: %v", evt, err)
+		}
+		if bad == nil && evt.What == COMMAND && (evt.Cmd == EHLO || evt.Cmd == MAILFROM || evt.Cmd == DATA) {
+			t.Fatalf("invalid reply for %+v accepted", evt)
+		}
+		if conn.Reply(554, "", "Twice") == nil {
+			t.Fatalf("second reply for %+v accepted", evt)
+		}
+	})
+	last := evts[len(evts)-1]
+	for _, l := range []string{"250 2.1.0 Sender ok\r\n", "251 2.1.5 User not local; will forward to <c@e.com>\r\n", "452 4.5.3 Too many recipients\r\n", "354 Go ahead\r\n", "552 5.3.4 Message too big for system\r\n"} {
+		if !strings.Contains(out, l) {
+			t.Fatalf("missing '%s' in output:\n%s", l, out)
+		}
+	}
+	if !strings.HasSuffix(out, "\r\n421 Going away\r\n") || last.What != ABORT {
+		t.Fatalf("connection not closed after 421: %v\n%s", last.What, out)
+	}
+
+	// A streamed message that the Conn rejects itself can't also be
+	// replied to.
+	lim := DefaultLimits
+	lim.MsgSize = 5
+	var rerr error
+	client = "HELO localhost\r\nMAIL FROM:<a@b.com>\r\nRCPT TO:<c@d.com>\r\nDATA\r\nThis is too big\r\n.\r\nQUIT\r\n"
+	_, _, out = runConn(Config{Limits: &lim, StreamData: true}, strings.NewReader(client), nil, func(conn *Conn, evt EventInfo) {
+		if evt.What == GOTDATA {
+			rerr = conn.Reply(250, "2.0.0", "Got it")
+		}
+	})
+	if rerr == nil || strings.Contains(out, "Got it") || !strings.Contains(out, "552 5.3.4 Message too big\r\n") {
+		t.Fatalf("Reply after our own reply not refused: %v\n%s", rerr, out)
+	}
+}
+
+// With StreamData, messages are delivered through EventInfo.Data.
+// The first message is read in full, the second is accepted unread,
+// and the third is too big.
+var streamClient = `EHLO localhost
+MAIL FROM:<a@b.com>
+RCPT TO:<c@d.org>
+DATA
+..line one
+line two
+.
+MAIL FROM:<a@b.com>
+RCPT TO:<c@d.org>
+DATA
+skipped
+.
+MAIL FROM:<a@b.com>
+RCPT TO:<c@d.org>
+DATA
+this message is much too big
+.
+QUIT
+`
+
+func TestStreamData(t *testing.T) {
+	lim := DefaultLimits
+	lim.MsgSize = 25
+	client := strings.Join(strings.Split(streamClient, "\n"), "\r\n")
+	var msgs []string
+	var errs []error
+	_, evts, out := runConn(Config{Limits: &lim, StreamData: true}, strings.NewReader(client), nil, func(conn *Conn, evt EventInfo) {
+		if evt.What != GOTDATA {
+			return
+		}
+		if evt.Data == nil || evt.Arg != "" {
+			t.Fatalf("bad GOTDATA event: %+v", evt)
+		}
+		if len(msgs) == 1 {
+			// Accept() must skip the unread message.
+			msgs = append(msgs, "")
+			conn.AcceptData("skip")
+			return
+		}
+		b, err := io.ReadAll(evt.Data)
+		msgs = append(msgs, string(b))
+		errs = append(errs, err)
+	})
+	last := evts[len(evts)-1].What
+	if len(msgs) != 3 || msgs[0] != ".line one\nline two\n" {
+		t.Fatalf("wrong messages: %q", msgs)
+	}
+	if errs[0] != nil || errs[1] != ErrMsgTooBig {
+		t.Fatalf("wrong read errors: %v", errs)
+	}
+	if last != DONE {
+		t.Fatalf("oversized message ended the session: %v", last)
+	}
+	if strings.Count(out, "250 2.0.0 I've put it in a can") != 2 || !strings.HasSuffix(out, "552 5.3.4 Message too big\r\n221 2.0.0 Goodbye\r\n") {
+		t.Fatalf("wrong server output:\n%s", out)
+	}
+}
+
+// Cancelling the context of NextContext interrupts a read and gets
+// the client a 421.
+func TestNextContext(t *testing.T) {
+	sc, cc := net.Pipe()
+	defer cc.Close()
+	conn := NewConn(sc, Config{}, nil)
+	ctx, cancel := context.WithCancel(context.Background())
+	evts := make(chan EventInfo, 10)
+	go func() {
+		for {
+			evt := conn.NextContext(ctx)
+			evts <- evt
+			if evt.What == DONE || evt.What == ABORT {
+				sc.Close()
+				return
+			}
+		}
+	}()
+
+	rdr := bufio.NewReader(cc)
+	if line, _ := rdr.ReadString('\n'); !strings.HasPrefix(line, "220 ") {
+		t.Fatalf("bad greeting: '%s'", line)
+	}
+	cc.Write([]byte("HELO localhost\r\n"))
+	if evt := <-evts; evt.What != COMMAND || evt.Cmd != HELO {
+		t.Fatalf("wrong first event: %+v", evt)
+	}
+	if line, _ := rdr.ReadString('\n'); !strings.HasPrefix(line, "250 ") {
+		t.Fatalf("bad HELO reply: '%s'", line)
+	}
+	cancel()
+	if line, _ := rdr.ReadString('\n'); !strings.HasPrefix(line, "421 4.3.2 ") {
+		t.Fatalf("bad cancellation reply: '%s'", line)
+	}
+	evt := <-evts
+	if evt.What != ABORT || evt.Arg != "cancelled: context canceled" {
+		t.Fatalf("wrong final event: %+v", evt)
+	}
+	// It stays aborted.
+	if evt = conn.Next(); evt.What != ABORT {
+		t.Fatalf("wrong event after cancellation: %+v", evt)
+	}
+}
+
+// testTLSConfig returns a TLS configuration with a freshly generated
+// self-signed certificate.
+func testTLSConfig(t *testing.T) *tls.Config {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("cannot generate key: %v", err)
+	}
+	tmpl := x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		DNSNames:     []string{"localhost"},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &tmpl, &tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("cannot create certificate: %v", err)
+	}
+	cert := tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+	return &tls.Config{Certificates: []tls.Certificate{cert}}
+}
+
+// runImplicitTLS runs a Conn with cfg and ImplicitTLS on one end of a
+// pipe and returns the other end and a channel of the Conn's events.
+func runImplicitTLS(t *testing.T, cfg Config) (net.Conn, *Conn, chan EventInfo) {
+	sc, cc := net.Pipe()
+	cfg.TLSConfig = testTLSConfig(t)
+	cfg.ImplicitTLS = true
+	conn := NewConn(sc, cfg, nil)
+	evts := make(chan EventInfo, 10)
+	go func() {
+		for {
+			evt := conn.Next()
+			evts <- evt
+			if evt.What == DONE || evt.What == ABORT {
+				sc.Close()
+				close(evts)
+				return
+			}
+		}
+	}()
+	return cc, conn, evts
+}
+
+func TestImplicitTLS(t *testing.T) {
+	cc, conn, evts := runImplicitTLS(t, Config{})
+	tc := tls.Client(cc, &tls.Config{InsecureSkipVerify: true})
+	defer tc.Close()
+	// net.Pipe() is unbuffered, so we must write and read at the
+	// same time.
+	go tc.Write([]byte("EHLO localhost\r\nQUIT\r\n"))
+	out, _ := io.ReadAll(tc)
+	if !strings.HasPrefix(string(out), "220 ") || strings.Contains(string(out), "STARTTLS") || !strings.HasSuffix(string(out), "221 2.0.0 Goodbye\r\n") {
+		t.Fatalf("wrong server output:\n%s", out)
+	}
+	for evt := range evts {
+		if evt.What == TLSERROR {
+			t.Fatalf("unexpected TLS error: %v", evt.Arg)
+		}
+	}
+	if !conn.TLSOn || conn.TLSCipher == 0 {
+		t.Fatalf("TLS state not set: %v 0x%04x", conn.TLSOn, conn.TLSCipher)
+	}
+}
+
+// A client that doesn't do TLS gets no banner and a TLSERROR.
+func TestImplicitTLSFailure(t *testing.T) {
+	cc, _, evts := runImplicitTLS(t, Config{})
+	defer cc.Close()
+	go func() {
+		cc.Write([]byte("EHLO localhost\r\n"))
+		io.Copy(io.Discard, cc)
+	}()
+	var got []Event
+	for evt := range evts {
+		got = append(got, evt.What)
+	}
+	if len(got) != 2 || got[0] != TLSERROR || got[1] != ABORT {
+		t.Fatalf("wrong events: %v", got)
+	}
+}
+
+// REQUIRETLS is only advertised and accepted under TLS.
+func TestRequireTLS(t *testing.T) {
+	cfg := Config{RequireTLS: true, TLSConfig: testTLSConfig(t)}
+	_, out := runSmtpEvents(cfg, "EHLO localhost\nMAIL FROM:<a@b.com> REQUIRETLS\nQUIT\n")
+	if strings.Contains(out, "250-REQUIRETLS") || !strings.Contains(out, "\r\n530 5.7.10 ") {
+		t.Fatalf("wrong cleartext server output:\n%s", out)
+	}
+
+	cc, _, evts := runImplicitTLS(t, Config{RequireTLS: true})
+	tc := tls.Client(cc, &tls.Config{InsecureSkipVerify: true})
+	defer tc.Close()
+	go tc.Write([]byte("EHLO localhost\r\nMAIL FROM:<a@b.com> REQUIRETLS=yes\r\nMAIL FROM:<a@b.com> REQUIRETLS\r\nRCPT TO:<c@d.com>\r\nDATA\r\nHi.\r\n.\r\nQUIT\r\n"))
+	o, _ := io.ReadAll(tc)
+	if !strings.Contains(string(o), "\r\n250-REQUIRETLS\r\n") || !strings.Contains(string(o), "\r\n501 5.5.4 REQUIRETLS does not take a value\r\n") || !strings.Contains(string(o), "\r\n250 2.0.0 ") {
+		t.Fatalf("wrong TLS server output:\n%s", o)
+	}
+	for evt := range evts {
+		want := evt.What == GOTDATA || evt.Cmd == MAILFROM || evt.Cmd == RCPTTO || evt.Cmd == DATA
+		if evt.RequireTLS != want {
+			t.Fatalf("wrong RequireTLS flag on event %+v", evt)
+		}
+	}
+}
+
+// LMTP replies to a message once for each accepted recipient.
+func TestLMTP(t *testing.T) {
+	client := "HELO localhost\r\nLHLO localhost\r\nMAIL FROM:<a@b.com>\r\nRCPT TO:<c@d.com>\r\nRCPT TO:<bad@d.com>\r\nRCPT TO:<e@d.com>\r\nDATA\r\nHi.\r\n.\r\nMAIL FROM:<a@b.com>\r\nRCPT TO:<c@d.com>\r\nRCPT TO:<e@d.com>\r\nDATA\r\nHi.\r\n.\r\nQUIT\r\n"
+	msgs := 0
+	_, _, out := runConn(Config{LMTP: true}, strings.NewReader(client), nil, func(conn *Conn, evt EventInfo) {
+		switch {
+		case evt.Cmd == RCPTTO && evt.Arg == "bad@d.com":
+			conn.Reject()
+		case evt.What == GOTDATA:
+			msgs++
+			// We leave the second message to Next().
+			if msgs == 1 {
+				conn.AcceptMsgEnhanced("2.1.5", "c@d.com delivered")
+				conn.TempfailMsgEnhanced("4.2.2", "e@d.com is over quota")
+			}
+		}
+	})
+	want := lmtpServer[strings.Index(lmtpServer, "550 "):]
+	want = strings.Join(strings.Split(want, "\n"), "\r\n")
+	if !strings.Contains(out, "502 5.5.1 Not supported\r\n250-localhost Hello") || !strings.HasSuffix(out, want) {
+		t.Fatalf("Got:\n%s\nExpected to end:\n%s", out, want)
+	}
+
+	// A 421 for the message closes the session without replies
+	// for the other recipients.
+	client = "LHLO localhost\r\nMAIL FROM:<a@b.com>\r\nRCPT TO:<c@d.com>\r\nRCPT TO:<e@d.com>\r\nDATA\r\nHi.\r\n.\r\nQUIT\r\n"
+	_, evts, out := runConn(Config{LMTP: true}, strings.NewReader(client), nil, func(conn *Conn, evt EventInfo) {
+		if evt.What == GOTDATA {
+			conn.Reply(421, "4.3.0", "Going away")
+			conn.Accept()
+		}
+	})
+	if last := evts[len(evts)-1]; last.What != ABORT || !strings.HasSuffix(out, "\r\n354 Send away\r\n421 4.3.0 Going away\r\n") {
+		t.Fatalf("421 did not close the LMTP session: %+v\n%s", last, out)
+	}
+}
+
+var lmtpServer = `550 5.1.0 Bad address
+250 2.1.5 Okay, I'll believe you for now
+354 Send away
+250 2.1.5 c@d.com delivered
+450 4.2.2 e@d.com is over quota
+250 2.1.0 Okay, I'll believe you for now
+250 2.1.5 Okay, I'll believe you for now
+250 2.1.5 Okay, I'll believe you for now
+354 Send away
+250 2.0.0 I've put it in a can
+250 2.0.0 I've put it in a can
+221 2.0.0 Goodbye
+`
@@ -0,0 +1,171 @@
+//
+// Spooling of large messages to temporary files, so that the memory
+// a Conn uses doesn't grow with the size of the messages it gets.
+
+package smtpd
+
+import (
+	"errors"
+	"io"
+	"os"
+	"strings"
+)
+
+// Spool is a message that was larger than Config.SpoolSize, which the
+// Conn has written to a temporary file in Config.SpoolDir instead of
+// keeping it in memory. It is the EventInfo.Data of its GOTDATA event.
+// A Spool is only valid until the next call to Next(), which closes
+// it and removes its file; you can Close it yourself before then.
+type Spool struct {
+	f    *os.File
+	hdr  string // the Received header, if any
+	size int64  // of the file
+	off  int64
+}
+
+// Read reads from the message.
+func (s *Spool) Read(b []byte) (int, error) {
+	if s.f == nil {
+		return 0, os.ErrClosed
+	}
+	n := 0
+	if s.off < int64(len(s.hdr)) {
+		n = copy(b, s.hdr[s.off:])
+		s.off += int64(n)
+		if n == len(b) {
+			return n, nil
+		}
+	}
+	k, err := s.f.ReadAt(b[n:], s.off-int64(len(s.hdr)))
+	s.off += int64(k)
+	return n + k, err
+}
+
+// Seek sets where the next Read reads from, as io.Seeker does.
+func (s *Spool) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += s.off
+	case io.SeekEnd:
+		offset += s.Size()
+	default:
+		return s.off, errors.New("invalid whence")
+	}
+	if offset < 0 {
+		return s.off, errors.New("negative position")
+	}
+	s.off = offset
+	return offset, nil
+}
+
+// Size returns the size of the message.
+func (s *Spool) Size() int64 {
+	return int64(len(s.hdr)) + s.size
+}
+
+// Close closes the Spool and removes its file. It can be called more
+// than once.
+func (s *Spool) Close() error {
+	if s.f == nil {
+		return nil
+	}
+	err := s.f.Close()
+	os.Remove(s.f.Name())
+	s.f = nil
+	return err
+}
+
+// spooler collects a message as it is read, in memory until it gets
+// larger than max and then in a temporary file in dir. Once writing
+// to the file fails, the rest of the message is thrown away so that
+// the caller can still read to its end.
+type spooler struct {
+	dir  string
+	max  int64 // zero if we never spool
+	mem  strings.Builder
+	f    *os.File
+	size int64
+	err  error
+}
+
+func (c *Conn) newSpooler() *spooler {
+	return &spooler{dir: c.cfg.SpoolDir, max: c.cfg.SpoolSize}
+}
+
+func (s *spooler) Write(b []byte) (int, error) {
+	s.size += int64(len(b))
+	if s.err == nil && s.f == nil && s.max > 0 && s.size > s.max {
+		s.spill()
+	}
+	switch {
+	case s.err != nil:
+	case s.f != nil:
+		_, s.err = s.f.Write(b)
+	default:
+		s.mem.Write(b)
+	}
+	return len(b), nil
+}
+
+// spill moves what we have so far from memory to a new temporary
+// file.
+func (s *spooler) spill() {
+	s.f, s.err = os.CreateTemp(s.dir, "smtpd-spool-")
+	if s.err != nil {
+		s.f = nil
+		return
+	}
+	_, s.err = io.WriteString(s.f, s.mem.String())
+	s.mem.Reset()
+}
+
+// Len returns how much has been written.
+func (s *spooler) Len() int64 {
+	return s.size
+}
+
+// String returns what has been written if it is in memory.
+func (s *spooler) String() string {
+	return s.mem.String()
+}
+
+// spool returns the Spool for what has been written if it went to a
+// file, or nil if it is in memory. The Spool takes over the file.
+func (s *spooler) spool() (*Spool, error) {
+	if s.err != nil {
+		err := s.err
+		s.discard()
+		return nil, err
+	}
+	if s.f == nil {
+		return nil, nil
+	}
+	sp := &Spool{f: s.f, size: s.size}
+	s.f = nil
+	return sp, nil
+}
+
+// discard throws away what has been written, removing any file. It
+// does nothing to a nil spooler.
+func (s *spooler) discard() {
+	if s == nil {
+		return
+	}
+	if s.f != nil {
+		s.f.Close()
+		os.Remove(s.f.Name())
+		s.f = nil
+	}
+	s.mem.Reset()
+}
+
+// spoolFailed replies to a message that we could not spool, once
+// for every recipient for LMTP.
+func (c *Conn) spoolFailed(err error) {
+	c.logErr(err, false, "could not spool message: %v", err)
+	for !c.replied && c.state != sAbort {
+		c.reply("452 4.3.1 Insufficient system storage")
+		c.replyDone()
+	}
+}
@@ -0,0 +1,102 @@
+//
+// Tests for spooling large messages to temporary files.
+
+package smtpd
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// runSpool runs client against a Conn with cfg, accepting everything.
+// It returns the GOTDATA messages, with a '*' in front of the ones
+// that were spooled, and the server output. It checks that spool
+// files go away once the caller is done with them.
+func runSpool(t *testing.T, cfg Config, client string) ([]string, string) {
+	var msgs []string
+	client = strings.Replace(client, "\n", "\r\n", -1)
+	_, _, out := runConn(cfg, strings.NewReader(client), nil, func(_ *Conn, evt EventInfo) {
+		if evt.What == DONE || evt.What == ABORT {
+			return
+		}
+		if files, _ := filepath.Glob(filepath.Join(cfg.SpoolDir, "*")); len(files) > 0 && evt.Data == nil {
+			t.Fatalf("spool files left behind: %v", files)
+		}
+		if evt.What != GOTDATA {
+			return
+		}
+		sp, ok := evt.Data.(*Spool)
+		if !ok {
+			msgs = append(msgs, evt.Arg)
+			return
+		}
+		// Read it twice to check Seek.
+		b, err := io.ReadAll(sp)
+		if err != nil {
+			t.Fatalf("reading spool: %v", err)
+		}
+		if _, err = sp.Seek(int64(len(b)/2), io.SeekStart); err != nil {
+			t.Fatalf("seeking spool: %v", err)
+		}
+		b2, _ := io.ReadAll(sp)
+		if string(b2) != string(b[len(b)/2:]) || sp.Size() != int64(len(b)) {
+			t.Fatalf("bad re-read of spool: %q vs %q", b2, b)
+		}
+		msgs = append(msgs, "*"+string(b))
+	})
+	if files, _ := filepath.Glob(filepath.Join(cfg.SpoolDir, "*")); len(files) > 0 {
+		t.Fatalf("spool files left behind at end: %v", files)
+	}
+	return msgs, out
+}
+
+func TestSpool(t *testing.T) {
+	cfg := Config{SpoolSize: 20, SpoolDir: t.TempDir(), Chunking: true}
+	msg := "MAIL FROM:<a@b.com>\nRCPT TO:<c@d.org>\n"
+	big := strings.Repeat("This is big.\n", 5)
+	client := "EHLO localhost\n" + msg + "DATA\nSmall\n.\n" + msg + "DATA\n" + big + ".\n" + msg + "BDAT 10\n0123456789BDAT 15 LAST\n012345678901234" + msg + "BDAT 5 LAST\nsmallQUIT\n"
+	msgs, out := runSpool(t, cfg, client)
+	want := []string{"Small\n", "*" + big, "*0123456789012345678901234", "small"}
+	if strings.Join(msgs, "|") != strings.Join(want, "|") {
+		t.Fatalf("wrong messages: %q\n%s", msgs, out)
+	}
+
+	// The Received header comes first.
+	cfg.AddReceived = true
+	msgs, out = runSpool(t, cfg, "EHLO localhost\n"+msg+"DATA\n"+big+".\nQUIT\n")
+	if len(msgs) != 1 || !strings.HasPrefix(msgs[0], "*Received: from localhost") || !strings.HasSuffix(msgs[0], "\n"+big) {
+		t.Fatalf("wrong spooled message: %q\n%s", msgs, out)
+	}
+
+	// A spool we can't write is a temporary failure.
+	cfg = Config{SpoolSize: 20, SpoolDir: filepath.Join(t.TempDir(), "missing")}
+	msgs, out = runSpool(t, cfg, "HELO localhost\n"+msg+"DATA\n"+big+".\nRSET\n"+msg+"DATA\nSmall\n.\nQUIT\n")
+	if len(msgs) != 1 || msgs[0] != "Small\n" || !strings.Contains(out, "\r\n452 4.3.1 Insufficient system storage\r\n") {
+		t.Fatalf("spool failure not handled: %q\n%s", msgs, out)
+	}
+	if _, err := os.Stat(cfg.SpoolDir); err == nil {
+		t.Fatalf("spool directory was created")
+	}
+}
+
+func TestSpoolClose(t *testing.T) {
+	dir := t.TempDir()
+	s := &spooler{dir: dir, max: 2}
+	io.WriteString(s, "hello")
+	sp, err := s.spool()
+	if err != nil || sp == nil {
+		t.Fatalf("no spool: %v", err)
+	}
+	if err = sp.Close(); err != nil {
+		t.Fatalf("close failed: %v", err)
+	}
+	if files, _ := filepath.Glob(filepath.Join(dir, "*")); len(files) > 0 {
+		t.Fatalf("spool file not removed: %v", files)
+	}
+	if _, err = sp.Read(make([]byte, 10)); err != os.ErrClosed || sp.Close() != nil {
+		t.Fatalf("wrong behavior after Close: %v", err)
+	}
+}
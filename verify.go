@@ -0,0 +1,82 @@
+//
+// VRFY and EXPN support, per section 3.5 of
+// http://tools.ietf.org/html/rfc5321. We handle the replies and
+// limits ourselves and call out to a Verifier for the answers.
+
+package smtpd
+
+import (
+	"strings"
+)
+
+// Verifier answers VRFY and EXPN commands for a Conn. cmd is VRFY or
+// EXPN and arg is its argument, which is a user name, a mailbox, or
+// (for EXPN) a list name. Verify can log the attempt with c.Log() if
+// it wants to.
+//
+// The return is one of the RFC 5321 answers:
+//
+//	250	mailboxes is the user (VRFY) or the list members (EXPN)
+//	251	the user is not local and mail will be forwarded to mailboxes[0]
+//	252	the user can't be verified but mail will be attempted
+//	550	there is no such user or list
+//	551	the user is not local; the client should try mailboxes[0]
+//	553	arg is ambiguous; mailboxes are the possibilities
+//
+// Each of mailboxes is given to the client as is, so it should be a
+// '<...>' address, optionally preceded by a name, eg
+// 'Fred Smith <fred@example.com>'. A non-nil error makes the
+// command fail temporarily, regardless of code. So does any other
+// code.
+type Verifier interface {
+	Verify(c *Conn, cmd Command, arg string) (code int, mailboxes []string, err error)
+}
+
+// VerifierFunc is an adapter to allow ordinary functions to be
+// Verifiers.
+type VerifierFunc func(c *Conn, cmd Command, arg string) (int, []string, error)
+
+// Verify calls f(c, cmd, arg).
+func (f VerifierFunc) Verify(c *Conn, cmd Command, arg string) (int, []string, error) {
+	return f(c, cmd, arg)
+}
+
+// verify handles a VRFY or EXPN command.
+func (c *Conn) verify(cmd Command, arg string) {
+	if c.cfg.Verifier == nil {
+		c.reply("502 5.5.1 Not supported")
+		return
+	}
+	// Clients that keep asking are probably harvesting addresses.
+	c.verifies++
+	if c.verifies > c.cfg.Limits.Verifies {
+		c.reply("502 5.7.0 Too many VRFY and EXPN commands")
+		return
+	}
+
+	code, mboxes, err := c.cfg.Verifier.Verify(c, cmd, arg)
+	if err != nil {
+		c.logErr(err, false, "verifier error: %v", err)
+		code = 0
+	}
+	one := len(mboxes) == 1
+	switch {
+	case code == 250 && len(mboxes) > 0:
+		c.replyMulti(250, "2.1.5", "%s", strings.Join(mboxes, "\n"))
+	case code == 251 && one:
+		c.reply("251 2.1.5 User not local; will forward to %s", mboxes[0])
+	case code == 252:
+		c.reply("252 2.1.5 Cannot verify user, but will accept message and attempt delivery")
+	case code == 550:
+		c.reply("550 5.1.1 No such user or list")
+	case code == 551 && one:
+		c.reply("551 5.1.6 User not local; please try %s", mboxes[0])
+	case code == 553 && len(mboxes) > 0:
+		c.replyMulti(553, "5.1.4", "Ambiguous; possibilities are\n%s", strings.Join(mboxes, "\n"))
+	default:
+		if err == nil {
+			c.log(LogError, "bad verifier reply: %d %q", code, mboxes)
+		}
+		c.reply("450 4.3.0 Not available")
+	}
+}
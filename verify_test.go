@@ -0,0 +1,101 @@
+//
+// Tests for VRFY and EXPN.
+
+package smtpd
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func testVerifier(c *Conn, cmd Command, arg string) (int, []string, error) {
+	switch {
+	case cmd == EXPN && arg == "staff":
+		return 250, []string{"Fred <fred@example.com>", "<barney@example.com>"}, nil
+	case cmd == EXPN:
+		return 550, nil, nil
+	case arg == "fred":
+		return 250, []string{"Fred <fred@example.com>"}, nil
+	case arg == "joe":
+		return 251, []string{"<joe@example.org>"}, nil
+	case arg == "jim":
+		return 551, []string{"<jim@example.org>"}, nil
+	case arg == "j":
+		return 553, []string{"<jim@example.org>", "<joe@example.org>"}, nil
+	case arg == "error":
+		return 250, nil, errors.New("database on fire")
+	case arg == "bad":
+		return 251, nil, nil
+	}
+	return 252, nil, nil
+}
+
+var verifyClient = `VRFY fred
+EHLO localhost
+EXPN staff
+EXPN fred
+VRFY joe
+VRFY jim
+VRFY j
+VRFY error
+VRFY bad
+VRFY anyone
+VRFY fred
+QUIT
+`
+var verifyServer = `220 localhost go-smtpd
+250 2.1.5 Fred <fred@example.com>
+250-localhost Hello 127.10.10.100:56789
+250-8BITMIME
+250-PIPELINING
+250-ENHANCEDSTATUSCODES
+250-SIZE 5242880
+250 HELP
+250-2.1.5 Fred <fred@example.com>
+250 2.1.5 <barney@example.com>
+550 5.1.1 No such user or list
+251 2.1.5 User not local; will forward to <joe@example.org>
+551 5.1.6 User not local; please try <jim@example.org>
+553-5.1.4 Ambiguous; possibilities are
+553-5.1.4 <jim@example.org>
+553 5.1.4 <joe@example.org>
+450 4.3.0 Not available
+450 4.3.0 Not available
+502 5.7.0 Too many VRFY and EXPN commands
+502 5.7.0 Too many VRFY and EXPN commands
+221 2.0.0 Goodbye
+`
+
+func TestVerify(t *testing.T) {
+	lim := DefaultLimits
+	lim.Verifies = 8
+	cfg := Config{Limits: &lim, Verifier: VerifierFunc(testVerifier)}
+	_, actualout := runSmtpEvents(cfg, verifyClient)
+	server := strings.Join(strings.Split(verifyServer, "\n"), "\r\n")
+	if actualout != server {
+		t.Fatalf("Got:\n%s\nExpected:\n%s", actualout, server)
+	}
+
+	// Verifiers can log what they're asked.
+	var logged []string
+	cfg.Logger = LoggerFunc(func(c *Conn, e *LogEvent) {
+		if e.Dir == LogError {
+			logged = append(logged, e.Line)
+		}
+	})
+	cfg.Verifier = VerifierFunc(func(c *Conn, cmd Command, arg string) (int, []string, error) {
+		c.Log("asked to verify %s", arg)
+		return testVerifier(c, cmd, arg)
+	})
+	runSmtpEvents(cfg, "VRFY fred\nQUIT\n")
+	if len(logged) != 1 || logged[0] != "asked to verify fred" {
+		t.Fatalf("wrong verifier logging: %q", logged)
+	}
+
+	// Without a Verifier, they're refused as always.
+	_, actualout = runSmtpEvents(Config{}, "VRFY fred\nEXPN staff\nQUIT\n")
+	if strings.Count(actualout, "502 5.5.1 Not supported\r\n") != 2 {
+		t.Fatalf("wrong output without a Verifier:\n%s", actualout)
+	}
+}
@@ -0,0 +1,214 @@
+//
+// Support for the Postfix XCLIENT and XFORWARD extensions, per
+// http://www.postfix.org/XCLIENT_README.html and
+// http://www.postfix.org/XFORWARD_README.html. They let a trusted
+// proxy or content filter in front of us pass on the original
+// client's information.
+
+package smtpd
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// XClient is the client information from XCLIENT commands, which
+// replaces what the Conn would otherwise know about the client.
+// Empty fields are unknown. Name may be "[TEMPUNAVAIL]" if the
+// proxy's DNS lookup of the client failed temporarily.
+type XClient struct {
+	Name  string // verified hostname of the client
+	Addr  net.IP
+	Port  int
+	Proto string // SMTP or ESMTP
+	Helo  string
+	Login string // SASL login name, which becomes Conn.AuthUser
+}
+
+// XForward is the client information from XFORWARD commands, which
+// describes where the next message originally came from. Empty
+// fields are unknown.
+type XForward struct {
+	Name   string // verified hostname of the client
+	Addr   net.IP
+	Port   int
+	Proto  string // SMTP, ESMTP, or some other protocol name
+	Helo   string
+	Ident  string // the message's ID at the proxy
+	Source string // LOCAL or REMOTE
+}
+
+// The attributes we support, as we advertise them.
+const (
+	xclientAttrs  = "NAME ADDR PORT PROTO HELO LOGIN"
+	xforwardAttrs = "NAME ADDR PORT PROTO HELO IDENT SOURCE"
+)
+
+// xTrusted returns true if our actual client is in the trusted list
+// for XCLIENT and XFORWARD, which must not be empty.
+func (c *Conn) xTrusted() bool {
+	ip := remoteIP(c.conn.RemoteAddr())
+	for _, n := range c.cfg.XTrusted {
+		if ip != nil && n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// xParams parses the attributes of an XCLIENT or XFORWARD command,
+// which must all be in allowed. [UNAVAILABLE] values are returned
+// as "".
+func xParams(arg, allowed string) (Params, error) {
+	p, err := ParseParams(arg)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range p {
+		if !strings.Contains(" "+allowed+" ", " "+k+" ") {
+			return nil, fmt.Errorf("bad attribute name '%s'", k)
+		}
+		if v == "" {
+			return nil, fmt.Errorf("attribute '%s' needs a value", k)
+		}
+		if strings.ToUpper(v) == "[UNAVAILABLE]" {
+			p[k] = ""
+		}
+	}
+	return p, nil
+}
+
+// xAddrPort parses the ADDR and PORT attributes, if present, into
+// addr and port.
+func xAddrPort(p Params, addr *net.IP, port *int) error {
+	if v, ok := p["ADDR"]; ok {
+		ip := net.ParseIP(strings.TrimPrefix(strings.ToUpper(v), "IPV6:"))
+		switch {
+		case v == "":
+			*addr = nil
+		case ip == nil:
+			return fmt.Errorf("bad ADDR '%s'", v)
+		default:
+			*addr = ip
+		}
+	}
+	if v, ok := p["PORT"]; ok {
+		n, err := strconv.ParseUint(v, 10, 16)
+		switch {
+		case v == "":
+			*port = 0
+		case err != nil:
+			return fmt.Errorf("bad PORT '%s'", v)
+		default:
+			*port = int(n)
+		}
+	}
+	return nil
+}
+
+// xclient handles an XCLIENT command. On success the connection is
+// reset to just after the greeting banner, which we send again.
+func (c *Conn) xclient(arg string) {
+	switch {
+	case !c.cfg.XClient:
+		c.reply("502 5.5.1 Not supported")
+		return
+	case !c.xTrusted():
+		c.reply("550 5.7.0 Insufficient authorization")
+		return
+	case c.state&(sMail|sRcpt|sBdat) != 0:
+		c.reply("503 5.5.1 Mail transaction in progress")
+		return
+	}
+	p, err := xParams(arg, xclientAttrs)
+	if err != nil {
+		c.reply("501 5.5.4 Bad XCLIENT: %v", err)
+		return
+	}
+	// Attributes that aren't given keep their current values.
+	var x XClient
+	if c.XClient != nil {
+		x = *c.XClient
+	}
+	if err = xAddrPort(p, &x.Addr, &x.Port); err != nil {
+		c.reply("501 5.5.4 Bad XCLIENT: %v", err)
+		return
+	}
+	if v, ok := p["PROTO"]; ok {
+		v = strings.ToUpper(v)
+		if v != "" && v != "SMTP" && v != "ESMTP" {
+			c.reply("501 5.5.4 Bad XCLIENT: bad PROTO '%s'", v)
+			return
+		}
+		x.Proto = v
+	}
+	if v, ok := p["NAME"]; ok {
+		x.Name = v
+	}
+	if v, ok := p["HELO"]; ok {
+		x.Helo = v
+	}
+	if v, ok := p["LOGIN"]; ok {
+		x.Login = v
+	}
+	c.XClient = &x
+	c.log(LogError, "XCLIENT now %v name '%s' helo '%s' login '%s'", c.RemoteAddr(), x.Name, x.Helo, x.Login)
+
+	c.state = sInitial
+	c.AuthUser = x.Login
+	c.XForward = nil
+	c.banner()
+}
+
+// xforward handles an XFORWARD command.
+func (c *Conn) xforward(arg string) {
+	switch {
+	case !c.cfg.XForward:
+		c.reply("502 5.5.1 Not supported")
+		return
+	case !c.xTrusted():
+		c.reply("550 5.7.0 Insufficient authorization")
+		return
+	case c.state&(sMail|sRcpt|sBdat) != 0:
+		c.reply("503 5.5.1 Mail transaction in progress")
+		return
+	}
+	p, err := xParams(arg, xforwardAttrs)
+	if err != nil {
+		c.reply("501 5.5.4 Bad XFORWARD: %v", err)
+		return
+	}
+	var x XForward
+	if c.XForward != nil && !c.xfwdDone {
+		x = *c.XForward
+	}
+	if err = xAddrPort(p, &x.Addr, &x.Port); err != nil {
+		c.reply("501 5.5.4 Bad XFORWARD: %v", err)
+		return
+	}
+	for k, v := range p {
+		switch k {
+		case "NAME":
+			x.Name = v
+		case "PROTO":
+			x.Proto = v
+		case "HELO":
+			x.Helo = v
+		case "IDENT":
+			x.Ident = v
+		case "SOURCE":
+			x.Source = strings.ToUpper(v)
+		}
+	}
+	c.XForward = &x
+	c.xfwdDone = false
+	c.reply("250 2.0.0 Okay")
+}
+
+// xforwardDone notes that the mail transaction the current XFORWARD
+// attributes are for has ended.
+func (c *Conn) xforwardDone() {
+	c.xfwdDone = c.XForward != nil
+}
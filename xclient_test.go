@@ -0,0 +1,109 @@
+//
+// Tests for XCLIENT and XFORWARD.
+
+package smtpd
+
+import (
+	"net"
+	"strings"
+	"testing"
+)
+
+func xConfig(trusted string) Config {
+	_, n, _ := net.ParseCIDR(trusted)
+	return Config{XClient: true, XForward: true, XTrusted: []*net.IPNet{n}}
+}
+
+var xclientClient = `EHLO proxy
+MAIL FROM:<a@b.com>
+XCLIENT ADDR=192.0.2.1
+RSET
+XCLIENT ADDR=192.0.2.1 FRED=1
+XCLIENT PORT=99999
+XCLIENT ADDR=IPv6:2001:db8::1 PORT=2525 NAME=client.example.org LOGIN=fred+40example.com
+EHLO client
+XCLIENT NAME=[UNAVAILABLE]
+QUIT
+`
+var xclientServer = `220 localhost go-smtpd
+250-localhost Hello 127.10.10.100:56789
+250-8BITMIME
+250-PIPELINING
+250-ENHANCEDSTATUSCODES
+250-SIZE 5242880
+250-XCLIENT NAME ADDR PORT PROTO HELO LOGIN
+250-XFORWARD NAME ADDR PORT PROTO HELO IDENT SOURCE
+250 HELP
+250 2.1.0 Okay, I'll believe you for now
+503 5.5.1 Mail transaction in progress
+250 2.0.0 Okay
+501 5.5.4 Bad XCLIENT: bad attribute name 'FRED'
+501 5.5.4 Bad XCLIENT: bad PORT '99999'
+220 localhost go-smtpd
+250-localhost Hello [2001:db8::1]:2525
+250-8BITMIME
+250-PIPELINING
+250-ENHANCEDSTATUSCODES
+250-SIZE 5242880
+250-XCLIENT NAME ADDR PORT PROTO HELO LOGIN
+250-XFORWARD NAME ADDR PORT PROTO HELO IDENT SOURCE
+250 HELP
+220 localhost go-smtpd
+221 2.0.0 Goodbye
+`
+
+func TestXClient(t *testing.T) {
+	server := strings.Join(strings.Split(xclientServer, "\n"), "\r\n")
+	conn, _, out := runConn(xConfig("127.0.0.0/8"), strings.NewReader(strings.Replace(xclientClient, "\n", "\r\n", -1)), nil, nil)
+	if out != server {
+		t.Fatalf("Got:\n%s\nExpected:\n%s", out, server)
+	}
+	x := conn.XClient
+	if x == nil || x.Name != "" || x.Port != 2525 || x.Login != "fred@example.com" || conn.AuthUser != "fred@example.com" {
+		t.Fatalf("wrong XCLIENT information: %+v", x)
+	}
+
+	// Untrusted clients are refused and not told about it.
+	_, out = runSmtpEvents(xConfig("192.0.2.0/24"), "EHLO proxy\nXCLIENT ADDR=192.0.2.1\nXFORWARD ADDR=192.0.2.1\nQUIT\n")
+	if strings.Contains(out, "250-XCLIENT") || strings.Count(out, "550 5.7.0 Insufficient authorization\r\n") != 2 {
+		t.Fatalf("wrong output for untrusted client:\n%s", out)
+	}
+
+	// Neither can be used in the middle of a BDAT message.
+	cfg := xConfig("127.0.0.0/8")
+	cfg.Chunking = true
+	_, out = runSmtpEvents(cfg, "EHLO proxy\nMAIL FROM:<a@b.com>\nRCPT TO:<c@d.com>\nBDAT 3\nabcXCLIENT ADDR=192.0.2.1\nXFORWARD ADDR=192.0.2.1\nBDAT 3 LAST\ndefQUIT\n")
+	if strings.Count(out, "503 5.5.1 Mail transaction in progress\r\n") != 2 || !strings.Contains(out, "250 2.0.0 I've put it in a can\r\n") {
+		t.Fatalf("XCLIENT or XFORWARD allowed during BDAT:\n%s", out)
+	}
+}
+
+func TestXForward(t *testing.T) {
+	client := `EHLO filter
+XFORWARD NAME=client.example.org ADDR=192.0.2.1
+XFORWARD HELO=client IDENT=ABC123 SOURCE=remote
+MAIL FROM:<a@b.com>
+RCPT TO:<c@d.com>
+DATA
+Hi.
+.
+MAIL FROM:<a@b.com>
+QUIT
+`
+	var seen []*XForward
+	_, _, out := runConn(xConfig("127.0.0.0/8"), strings.NewReader(strings.Replace(client, "\n", "\r\n", -1)), nil, func(c *Conn, evt EventInfo) {
+		if evt.Cmd == MAILFROM {
+			seen = append(seen, c.XForward)
+		}
+	})
+	if strings.Count(out, "250 2.0.0 Okay\r\n") != 2 {
+		t.Fatalf("XFORWARD not accepted:\n%s", out)
+	}
+	if len(seen) != 2 || seen[1] != nil {
+		t.Fatalf("XFORWARD information not forgotten: %+v", seen)
+	}
+	x := seen[0]
+	if x == nil || x.Name != "client.example.org" || !x.Addr.Equal(net.ParseIP("192.0.2.1")) || x.Helo != "client" || x.Ident != "ABC123" || x.Source != "REMOTE" {
+		t.Fatalf("wrong XFORWARD information: %+v", x)
+	}
+}